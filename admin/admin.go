@@ -0,0 +1,178 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"web_proxy_cache/proxy_cache"
+	"web_proxy_cache/requestid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	Path = "/admin/cache/"
+)
+
+type admin struct {
+	token  string
+	caches map[string]*proxy_cache.Cache
+}
+
+type cacheSummary struct {
+	Provider string `json:"provider"`
+	Entries  int    `json:"entries"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type purgeResult struct {
+	Provider string `json:"provider"`
+	Purged   int    `json:"purged"`
+}
+
+// NewHandler creates the handler for the admin cache api. All requests must have the header
+// Authorization: Bearer <token>.
+//
+//	GET    /admin/cache/                       list all provider caches
+//	GET    /admin/cache/{provider}/            list entries, filtered by the query prefix or regex
+//	DELETE /admin/cache/{provider}/            purge entries matching the query prefix or regex, or all
+//	GET    /admin/cache/{provider}/entry?key=  get the entry for the key
+//	DELETE /admin/cache/{provider}/entry?key=  purge the entry for the key
+func NewHandler(token string, caches map[string]*proxy_cache.Cache) http.Handler {
+	a := &admin{
+		token:  token,
+		caches: caches,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+Path+"{$}", a.listCaches)
+	mux.HandleFunc("GET "+Path+"{provider}/{$}", a.listEntries)
+	mux.HandleFunc("DELETE "+Path+"{provider}/{$}", a.purgeEntries)
+	mux.HandleFunc("GET "+Path+"{provider}/entry", a.getEntry)
+	mux.HandleFunc("DELETE "+Path+"{provider}/entry", a.deleteEntry)
+	return a.authenticate(mux)
+}
+
+func (a *admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *admin) listCaches(w http.ResponseWriter, r *http.Request) {
+	summaries := []cacheSummary{}
+	for name, cache := range a.caches {
+		entries, bytes := cache.Len()
+		summaries = append(summaries, cacheSummary{Provider: name, Entries: entries, Bytes: bytes})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Provider < summaries[j].Provider
+	})
+	writeJSON(w, summaries)
+}
+
+func (a *admin) listEntries(w http.ResponseWriter, r *http.Request) {
+	cache, ok := a.cache(w, r)
+	if !ok {
+		return
+	}
+	match, err := keyMatcher(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, cache.Entries(match))
+}
+
+func (a *admin) purgeEntries(w http.ResponseWriter, r *http.Request) {
+	cache, ok := a.cache(w, r)
+	if !ok {
+		return
+	}
+	match, err := keyMatcher(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	purged := cache.Purge(r.Context(), match)
+	requestid.Log(r.Context()).WithFields(log.Fields{"operation": "admin", "proxy": cache.Name(), "query": r.URL.RawQuery, "purged": purged}).
+		Info("Purge cache")
+	writeJSON(w, purgeResult{Provider: cache.Name(), Purged: purged})
+}
+
+func (a *admin) getEntry(w http.ResponseWriter, r *http.Request) {
+	cache, ok := a.cache(w, r)
+	if !ok {
+		return
+	}
+	info, exists := cache.Info(r.URL.Query().Get("key"))
+	if !exists {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, info)
+}
+
+func (a *admin) deleteEntry(w http.ResponseWriter, r *http.Request) {
+	cache, ok := a.cache(w, r)
+	if !ok {
+		return
+	}
+	if !cache.Delete(r.Context(), r.URL.Query().Get("key")) {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, purgeResult{Provider: cache.Name(), Purged: 1})
+}
+
+// cache returns the cache of the provider in the request path
+func (a *admin) cache(w http.ResponseWriter, r *http.Request) (*proxy_cache.Cache, bool) {
+	name := r.PathValue("provider")
+	cache, ok := a.caches[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Provider %s not found", name), http.StatusNotFound)
+		return nil, false
+	}
+	return cache, true
+}
+
+// keyMatcher returns a matcher for the query parameter prefix or regex, or nil to match all keys
+func keyMatcher(r *http.Request) (func(key string) bool, error) {
+	query := r.URL.Query()
+	if query.Has("prefix") && query.Has("regex") {
+		return nil, fmt.Errorf("only one of prefix and regex can be used")
+	}
+	if query.Has("prefix") {
+		prefix := query.Get("prefix")
+		return func(key string) bool {
+			return strings.HasPrefix(key, prefix)
+		}, nil
+	}
+	if query.Has("regex") {
+		re, err := regexp.Compile(query.Get("regex"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		return re.MatchString, nil
+	}
+	return nil, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
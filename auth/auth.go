@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// APIKeyHeader is the request header with the client API key
+	APIKeyHeader = "X-Api-Key"
+	realm        = "web_proxy_cache"
+)
+
+// Config is the format of the client authentication file, YAML or JSON
+type Config struct {
+	Clients []ClientConfig `yaml:"clients"`
+	// HtpasswdFile is an htpasswd file with bcrypt hashes for basic auth, the users are clients by name
+	HtpasswdFile string `yaml:"htpasswd_file"`
+	// JWT enables JWT bearer tokens, the name claim is the client name
+	JWT *JWTConfig `yaml:"jwt"`
+	// Policies decide which clients may call which provider or route
+	Policies []PolicyConfig `yaml:"policies"`
+}
+
+// ClientConfig is a client of the proxy and the providers and targets it may use
+type ClientConfig struct {
+	Name string `yaml:"name"`
+	// APIKey or APIKeyFile is the key the client send in the X-Api-Key header
+	APIKey     string `yaml:"api_key"`
+	APIKeyFile string `yaml:"api_key_file"`
+	// Username and PasswordHash, a bcrypt hash, are the basic auth credentials of the client
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"`
+	// Providers maps a provider name to the targets, base URLs or aliases, the client may use. An empty
+	// list allows all targets of the provider. It is the same as a policy for the client.
+	Providers map[string][]string `yaml:"providers"`
+}
+
+// Client is an authenticated client
+type Client struct {
+	Name string
+	// Method is how the client was authenticated, api_key, basic or jwt
+	Method string
+	// Claims are the claims of the JWT
+	Claims map[string]interface{}
+}
+
+// dummyPasswordHash is a bcrypt hash with the default cost, compared for unknown users
+var dummyPasswordHash = []byte("$2a$10$xqehAPhMvVaRDPRtZ.yuC.XkZ0ptG9sI5Ee33yXbEkR2r0cIfAnjK")
+
+type user struct {
+	client       *Client
+	passwordHash []byte
+}
+
+// Authenticator authenticates the clients of the proxy and authorize them with the policies
+type Authenticator struct {
+	// apiKeys is keyed by the SHA-256 of the key so a lookup does not leak the key by timing
+	apiKeys  map[[sha256.Size]byte]*Client
+	users    map[string]user
+	jwt      *jwtValidator
+	policies []policy
+}
+
+// Load reads the client authentication file
+func Load(path string) (*Authenticator, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	authenticator, err := New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return authenticator, nil
+}
+
+// New validates the configuration and creates the authenticator
+func New(cfg Config) (*Authenticator, error) {
+	a := &Authenticator{
+		apiKeys: make(map[[sha256.Size]byte]*Client),
+		users:   make(map[string]user),
+	}
+	var errs []error
+	names := make(map[string]bool)
+	for i, clientCfg := range cfg.Clients {
+		if err := a.add(clientCfg, names); err != nil {
+			errs = append(errs, fmt.Errorf("client %d %q: %w", i, clientCfg.Name, err))
+		}
+		for provider, targets := range clientCfg.Providers {
+			a.policies = append(a.policies, policy{PolicyConfig{
+				Provider: provider,
+				Clients:  []string{clientCfg.Name},
+				Targets:  targets,
+			}})
+		}
+	}
+
+	if cfg.HtpasswdFile != "" {
+		users, err := readHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for username, hash := range users {
+			if _, exists := a.users[username]; exists {
+				errs = append(errs, fmt.Errorf("%s: duplicate username %q", cfg.HtpasswdFile, username))
+				continue
+			}
+			a.users[username] = user{client: &Client{Name: username, Method: "basic"}, passwordHash: hash}
+		}
+	}
+
+	if cfg.JWT != nil {
+		validator, err := newJWTValidator(*cfg.JWT)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("jwt: %w", err))
+		}
+		a.jwt = validator
+	}
+
+	for i, policyCfg := range cfg.Policies {
+		p, err := newPolicy(policyCfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("policy %d: %w", i, err))
+			continue
+		}
+		a.policies = append(a.policies, p)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return a, nil
+}
+
+func (a *Authenticator) add(cfg ClientConfig, names map[string]bool) error {
+	if cfg.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if names[cfg.Name] {
+		return fmt.Errorf("duplicate name")
+	}
+	names[cfg.Name] = true
+	client := &Client{Name: cfg.Name, Method: "api_key"}
+
+	apiKey := cfg.APIKey
+	if cfg.APIKeyFile != "" {
+		if apiKey != "" {
+			return fmt.Errorf("only one of api_key and api_key_file can be set")
+		}
+		content, err := os.ReadFile(cfg.APIKeyFile)
+		if err != nil {
+			return err
+		}
+		apiKey = strings.TrimSpace(string(content))
+	}
+	if apiKey != "" {
+		sum := sha256.Sum256([]byte(apiKey))
+		if _, exists := a.apiKeys[sum]; exists {
+			return fmt.Errorf("duplicate api key")
+		}
+		a.apiKeys[sum] = client
+	}
+
+	if cfg.Username != "" || cfg.PasswordHash != "" {
+		if cfg.Username == "" || cfg.PasswordHash == "" {
+			return fmt.Errorf("both username and password_hash must be set")
+		}
+		if _, err := bcrypt.Cost([]byte(cfg.PasswordHash)); err != nil {
+			return fmt.Errorf("password_hash must be a bcrypt hash: %w", err)
+		}
+		if _, exists := a.users[cfg.Username]; exists {
+			return fmt.Errorf("duplicate username %q", cfg.Username)
+		}
+		a.users[cfg.Username] = user{client: &Client{Name: cfg.Name, Method: "basic"}, passwordHash: []byte(cfg.PasswordHash)}
+	}
+
+	if apiKey == "" && cfg.Username == "" {
+		return fmt.Errorf("api_key, api_key_file or username is required")
+	}
+	return nil
+}
+
+// Authenticate returns the client of the request, from the X-Api-Key header, a JWT bearer token or
+// basic auth
+func (a *Authenticator) Authenticate(r *http.Request) (*Client, error) {
+	if apiKey := r.Header.Get(APIKeyHeader); apiKey != "" {
+		client, ok := a.apiKeys[sha256.Sum256([]byte(apiKey))]
+		if !ok {
+			return nil, errors.New("unknown api key")
+		}
+		return client, nil
+	}
+	if token, ok := bearerToken(r); ok && a.jwt != nil {
+		claims, err := a.jwt.validate(token, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %w", err)
+		}
+		name, _ := claims[a.jwt.cfg.NameClaim].(string)
+		return &Client{Name: name, Method: "jwt", Claims: claims}, nil
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		user, exists := a.users[username]
+		if !exists {
+			// Compare anyway so the response time does not tell if the user exists
+			_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+			return nil, fmt.Errorf("unknown user %q", username)
+		}
+		if bcrypt.CompareHashAndPassword(user.passwordHash, []byte(password)) != nil {
+			return nil, fmt.Errorf("wrong password for user %q", username)
+		}
+		return user.client, nil
+	}
+	return nil, errors.New("no credentials")
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+type contextKey struct{}
+
+// AccessFromContext returns the access of the authenticated client of the request context
+func AccessFromContext(ctx context.Context) (*Access, bool) {
+	access, ok := ctx.Value(contextKey{}).(*Access)
+	return access, ok
+}
+
+// Middleware rejects requests without valid client credentials with 401 and clients without a policy
+// for the route or provider with 403. The client credentials are removed from the request so they are
+// never sent to the upstream. The provider is empty for routes that are not a provider, e.g. /metrics.
+func (a *Authenticator) Middleware(route string, provider string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, err := a.Authenticate(r)
+		if err != nil {
+			log.WithFields(log.Fields{"operation": "auth", "uri": r.RequestURI, "remote": r.RemoteAddr, "error": err}).
+				Warn("Authentication failed")
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+			if a.jwt != nil {
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		access, ok := a.authorize(client, route, provider)
+		if !ok {
+			log.WithFields(log.Fields{"operation": "auth", "uri": r.RequestURI, "client": client.Name, "method": client.Method}).
+				Warn("Client not allowed")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		r.Header.Del(APIKeyHeader)
+		if client.Method != "api_key" {
+			r.Header.Del("Authorization")
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, access)))
+	})
+}
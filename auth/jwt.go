@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the allowed clock skew for exp and nbf
+const jwtLeeway = 60 * time.Second
+
+// JWTConfig is the validation of JWT bearer tokens
+type JWTConfig struct {
+	// JWKSFile is the JSON Web Key Set with the public keys of the issuer
+	JWKSFile string `yaml:"jwks_file"`
+	// Issuer and Audience must match the iss and aud claims if set
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// Claims are claims every token must have with one of the values
+	Claims map[string][]string `yaml:"claims"`
+	// NameClaim is the claim used as the client name, default sub
+	NameClaim string `yaml:"name_claim"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtValidator struct {
+	cfg  JWTConfig
+	keys map[string]crypto.PublicKey
+}
+
+func newJWTValidator(cfg JWTConfig) (*jwtValidator, error) {
+	if cfg.JWKSFile == "" {
+		return nil, fmt.Errorf("jwks_file is required")
+	}
+	content, err := os.ReadFile(cfg.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.JWKSFile, err)
+	}
+	if cfg.NameClaim == "" {
+		cfg.NameClaim = "sub"
+	}
+
+	v := &jwtValidator{cfg: cfg, keys: make(map[string]crypto.PublicKey)}
+	for i, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		publicKey, err := key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d %q: %w", cfg.JWKSFile, i, key.Kid, err)
+		}
+		v.keys[key.Kid] = publicKey
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("%s: no signing keys", cfg.JWKSFile)
+	}
+	return v, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// validate verifies the signature and the claims of the token and returns the claims
+func (v *jwtValidator) validate(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	if header.Kid != "" {
+		key, ok := v.keys[header.Kid]
+		verified = ok && verify(header.Alg, key, signed, signature)
+	} else {
+		for _, key := range v.keys {
+			if verify(header.Alg, key, signed, signature) {
+				verified = true
+				break
+			}
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	if err := v.checkClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *jwtValidator) checkClaims(claims map[string]interface{}, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("no exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not yet valid")
+	}
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return fmt.Errorf("issuer %v not accepted", claims["iss"])
+	}
+	if v.cfg.Audience != "" && !claimMatches(claims["aud"], []string{v.cfg.Audience}) {
+		return fmt.Errorf("audience %v not accepted", claims["aud"])
+	}
+	for claim, values := range v.cfg.Claims {
+		if !claimMatches(claims[claim], values) {
+			return fmt.Errorf("claim %s not accepted", claim)
+		}
+	}
+	if name, _ := claims[v.cfg.NameClaim].(string); name == "" {
+		return fmt.Errorf("no %s claim", v.cfg.NameClaim)
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verify checks the signature with the key, the algorithm must match the key type
+func verify(alg string, key crypto.PublicKey, signed []byte, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		h, hashFunc, ok := hashFor(alg, "RS", "PS")
+		if !ok {
+			return false
+		}
+		h.Write(signed)
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(key, hashFunc, h.Sum(nil), signature, nil) == nil
+		}
+		return rsa.VerifyPKCS1v15(key, hashFunc, h.Sum(nil), signature) == nil
+	case *ecdsa.PublicKey:
+		h, _, ok := hashFor(alg, "ES")
+		if !ok || ecdsaAlgorithms[key.Curve.Params().Name] != alg {
+			return false
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		h.Write(signed)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, h.Sum(nil), r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, signed, signature)
+	}
+	return false
+}
+
+// ecdsaAlgorithms is the only algorithm accepted for a key on each curve
+var ecdsaAlgorithms = map[string]string{
+	"P-256": "ES256",
+	"P-384": "ES384",
+	"P-521": "ES512",
+}
+
+// hashFor returns the hash of the algorithm, e.g. RS256, if it has one of the prefixes
+func hashFor(alg string, prefixes ...string) (hash.Hash, crypto.Hash, bool) {
+	if len(alg) != 5 || !contains(prefixes, alg[:2]) {
+		return nil, 0, false
+	}
+	switch alg[2:] {
+	case "256":
+		return sha256.New(), crypto.SHA256, true
+	case "384":
+		return sha512.New384(), crypto.SHA384, true
+	case "512":
+		return sha512.New(), crypto.SHA512, true
+	}
+	return nil, 0, false
+}
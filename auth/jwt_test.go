@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testKeys struct {
+	rsa   *rsa.PrivateKey
+	p256  *ecdsa.PrivateKey
+	p384  *ecdsa.PrivateKey
+	p521  *ecdsa.PrivateKey
+	ed    ed25519.PrivateKey
+	other *rsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	var keys testKeys
+	var err error
+	if keys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if keys.other, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if keys.p256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if keys.p384, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if keys.p521, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, keys.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) jwk {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return jwk{Kty: "EC", Kid: kid, Crv: key.Curve.Params().Name,
+		X: encode(key.X.FillBytes(make([]byte, size))), Y: encode(key.Y.FillBytes(make([]byte, size)))}
+}
+
+// writeJWKS writes the public keys, except other, to a JWKS file and returns the path
+func writeJWKS(t *testing.T, keys testKeys) string {
+	t.Helper()
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: []jwk{
+		{Kty: "RSA", Kid: "rsa", Use: "sig", N: encode(keys.rsa.N.Bytes()), E: encode(big.NewInt(int64(keys.rsa.E)).Bytes())},
+		ecJWK("p256", keys.p256),
+		ecJWK("p384", keys.p384),
+		ecJWK("p521", keys.p521),
+		{Kty: "OKP", Kid: "ed", Crv: "Ed25519", X: encode(keys.ed.Public().(ed25519.PublicKey))},
+	}}
+	content, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// sign returns a token with the header alg and kid, signed with key using the hash of signAlg
+func sign(t *testing.T, alg string, signAlg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := encode(header) + "." + encode(payload)
+	if key == nil {
+		return signed + "."
+	}
+
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	case *ecdsa.PrivateKey:
+		h, _, _ := hashFor(signAlg, "ES")
+		h.Write([]byte(signed))
+		r, s, signErr := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if signErr != nil {
+			t.Fatal(signErr)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	case *rsa.PrivateKey:
+		h, hashFunc, _ := hashFor(signAlg, "RS", "PS")
+		h.Write([]byte(signed))
+		if strings.HasPrefix(signAlg, "PS") {
+			signature, err = rsa.SignPSS(rand.Reader, key, hashFunc, h.Sum(nil), nil)
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, hashFunc, h.Sum(nil))
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + encode(signature)
+}
+
+func TestJWTValidate(t *testing.T) {
+	keys := newTestKeys(t)
+	v, err := newJWTValidator(JWTConfig{
+		JWKSFile: writeJWKS(t, keys),
+		Issuer:   "https://issuer.example",
+		Audience: "web_proxy_cache",
+		Claims:   map[string][]string{"groups": {"netops", "admins"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":    "alice",
+			"iss":    "https://issuer.example",
+			"aud":    []string{"other", "web_proxy_cache"},
+			"groups": []string{"netops"},
+			"exp":    now.Add(time.Hour).Unix(),
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(c, name)
+				continue
+			}
+			c[name] = value
+		}
+		return c
+	}
+	valid := claims(nil)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "RS256", token: sign(t, "RS256", "RS256", "rsa", keys.rsa, valid)},
+		{name: "RS512", token: sign(t, "RS512", "RS512", "rsa", keys.rsa, valid)},
+		{name: "PS256", token: sign(t, "PS256", "PS256", "rsa", keys.rsa, valid)},
+		{name: "ES256", token: sign(t, "ES256", "ES256", "p256", keys.p256, valid)},
+		{name: "ES384", token: sign(t, "ES384", "ES384", "p384", keys.p384, valid)},
+		{name: "ES512", token: sign(t, "ES512", "ES512", "p521", keys.p521, valid)},
+		{name: "EdDSA", token: sign(t, "EdDSA", "EdDSA", "ed", keys.ed, valid)},
+		{name: "no kid", token: sign(t, "ES256", "ES256", "", keys.p256, valid)},
+		{name: "unknown kid", token: sign(t, "RS256", "RS256", "unknown", keys.rsa, valid), wantErr: "invalid signature"},
+		{name: "other key", token: sign(t, "RS256", "RS256", "rsa", keys.other, valid), wantErr: "invalid signature"},
+		{name: "other key without kid", token: sign(t, "RS256", "RS256", "", keys.other, valid), wantErr: "invalid signature"},
+		{name: "tampered claims", token: tamper(sign(t, "RS256", "RS256", "rsa", keys.rsa, valid), claims(map[string]interface{}{"sub": "mallory"})),
+			wantErr: "invalid signature"},
+		{name: "alg none", token: sign(t, "none", "", "rsa", nil, valid), wantErr: "invalid signature"},
+		{name: "alg none without kid", token: sign(t, "none", "", "", nil, valid), wantErr: "invalid signature"},
+		{name: "HS256", token: sign(t, "HS256", "RS256", "rsa", keys.rsa, valid), wantErr: "invalid signature"},
+		{name: "RS256 on EC key", token: sign(t, "RS256", "ES256", "p256", keys.p256, valid), wantErr: "invalid signature"},
+		{name: "ES512 on P-256 key", token: sign(t, "ES512", "ES512", "p256", keys.p256, valid), wantErr: "invalid signature"},
+		{name: "ES256 on P-384 key", token: sign(t, "ES256", "ES256", "p384", keys.p384, valid), wantErr: "invalid signature"},
+		{name: "ES384 on P-521 key", token: sign(t, "ES384", "ES384", "p521", keys.p521, valid), wantErr: "invalid signature"},
+		{name: "ES256 on Ed25519 key", token: sign(t, "ES256", "ES256", "ed", keys.p256, valid), wantErr: "invalid signature"},
+		{name: "malformed", token: "a.b", wantErr: "malformed token"},
+		{name: "no exp", token: sign(t, "RS256", "RS256", "rsa", keys.rsa, claims(map[string]interface{}{"exp": nil})),
+			wantErr: "no exp claim"},
+		{name: "expired in leeway", token: sign(t, "RS256", "RS256", "rsa", keys.rsa,
+			claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}))},
+		{name: "expired", token: sign(t, "RS256", "RS256", "rsa", keys.rsa,
+			claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})), wantErr: "token expired"},
+		{name: "nbf in leeway", token: sign(t, "RS256", "RS256", "rsa", keys.rsa,
+			claims(map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}))},
+		{name: "nbf", token: sign(t, "RS256", "RS256", "rsa", keys.rsa,
+			claims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()})), wantErr: "token not yet valid"},
+		{name: "wrong issuer", token: sign(t, "RS256", "RS256", "rsa", keys.rsa,
+			claims(map[string]interface{}{"iss": "https://evil.example"})), wantErr: "issuer"},
+		{name: "audience string", token: sign(t, "RS256", "RS256", "rsa", keys.rsa,
+			claims(map[string]interface{}{"aud": "web_proxy_cache"}))},
+		{name: "wrong audience", token: sign(t, "RS256", "RS256", "rsa", keys.rsa,
+			claims(map[string]interface{}{"aud": []string{"other"}})), wantErr: "audience"},
+		{name: "claim string", token: sign(t, "RS256", "RS256", "rsa", keys.rsa,
+			claims(map[string]interface{}{"groups": "admins"}))},
+		{name: "wrong claim", token: sign(t, "RS256", "RS256", "rsa", keys.rsa,
+			claims(map[string]interface{}{"groups": []string{"guests"}})), wantErr: "claim groups"},
+		{name: "no name claim", token: sign(t, "RS256", "RS256", "rsa", keys.rsa,
+			claims(map[string]interface{}{"sub": nil})), wantErr: "no sub claim"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.validate(tt.token, now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() error = %v", err)
+				}
+				if claims["sub"] != "alice" {
+					t.Errorf("validate() sub = %v, want alice", claims["sub"])
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// tamper replaces the claims of the token and keeps the header and signature
+func tamper(token string, claims map[string]interface{}) string {
+	parts := strings.Split(token, ".")
+	payload, _ := json.Marshal(claims)
+	return parts[0] + "." + encode(payload) + "." + parts[2]
+}
+
+func TestNewJWTValidator(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "jwks.json")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "no keys", content: `{"keys":[]}`, wantErr: "no signing keys"},
+		{name: "only encryption keys", content: `{"keys":[{"kty":"OKP","use":"enc","crv":"Ed25519","x":"AA"}]}`, wantErr: "no signing keys"},
+		{name: "unknown key type", content: `{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`, wantErr: "unsupported key type"},
+		{name: "unknown curve", content: `{"keys":[{"kty":"EC","crv":"secp256k1","x":"AA","y":"AA"}]}`, wantErr: "unsupported curve"},
+		{name: "point not on curve", content: `{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`, wantErr: "not on curve"},
+		{name: "invalid json", content: `{`, wantErr: "jwks.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newJWTValidator(JWTConfig{JWKSFile: write(t, tt.content)})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("newJWTValidator() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AnyClient in the clients of a policy matches all authenticated clients
+const AnyClient = "*"
+
+// PolicyConfig decides which clients may call a route, and which targets they may use
+type PolicyConfig struct {
+	// Provider is the name of the provider, or Route the path, e.g. /metrics, the policy is for
+	Provider string `yaml:"provider"`
+	Route    string `yaml:"route"`
+	// Clients are the client names, htpasswd users or JWT subjects allowed, or * for all clients
+	Clients []string `yaml:"clients"`
+	// Claims are JWT claims that must all have one of the values, a claim can be a string or a list
+	Claims map[string][]string `yaml:"claims"`
+	// Targets are the base URLs or aliases of the provider the clients may use, empty allow all targets
+	Targets []string `yaml:"targets"`
+}
+
+type policy struct {
+	PolicyConfig
+}
+
+func newPolicy(cfg PolicyConfig) (policy, error) {
+	if (cfg.Provider == "") == (cfg.Route == "") {
+		return policy{}, fmt.Errorf("exactly one of provider and route must be set")
+	}
+	if len(cfg.Clients) == 0 && len(cfg.Claims) == 0 {
+		return policy{}, fmt.Errorf("clients or claims must be set")
+	}
+	return policy{PolicyConfig: cfg}, nil
+}
+
+// appliesTo returns true if the policy is for the route or the provider
+func (p policy) appliesTo(route string, provider string) bool {
+	if p.Provider != "" {
+		return p.Provider == provider
+	}
+	return p.Route == route
+}
+
+// matches returns true if the client match both the clients and the claims of the policy
+func (p policy) matches(client *Client) bool {
+	if len(p.Clients) > 0 && !contains(p.Clients, client.Name) && !contains(p.Clients, AnyClient) {
+		return false
+	}
+	for claim, values := range p.Claims {
+		if !claimMatches(client.Claims[claim], values) {
+			return false
+		}
+	}
+	return true
+}
+
+func claimMatches(claim interface{}, values []string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return contains(values, claim)
+	case []interface{}:
+		for _, item := range claim {
+			if s, ok := item.(string); ok && contains(values, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Access is what an authenticated client may do on the route it called
+type Access struct {
+	Client *Client
+	all    bool
+	// targets are the base URLs or aliases the client may use
+	targets []string
+}
+
+// Allowed returns true if the client may use the target. The target is matched both as sent by the
+// client, e.g. an alias, and as the resolved base URL.
+func (a *Access) Allowed(requested string, target string) bool {
+	if a.all {
+		return true
+	}
+	for _, allowed := range a.targets {
+		allowed = strings.TrimSuffix(allowed, "/")
+		if allowed == requested || allowed == target {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize returns the access of the client from all policies of the route or provider that match the
+// client, false if there are none
+func (a *Authenticator) authorize(client *Client, route string, provider string) (*Access, bool) {
+	access := &Access{Client: client}
+	matched := false
+	for _, p := range a.policies {
+		if !p.appliesTo(route, provider) || !p.matches(client) {
+			continue
+		}
+		matched = true
+		if len(p.Targets) == 0 {
+			access.all = true
+		}
+		access.targets = append(access.targets, p.Targets...)
+	}
+	return access, matched
+}
+
+// HasRoute returns true if any policy is for the route
+func (a *Authenticator) HasRoute(route string) bool {
+	for _, p := range a.policies {
+		if p.Route == route {
+			return true
+		}
+	}
+	return false
+}
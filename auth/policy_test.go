@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"testing"
+)
+
+func TestNewPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     PolicyConfig
+		wantErr bool
+	}{
+		{name: "provider", cfg: PolicyConfig{Provider: "netbox", Clients: []string{"alice"}}},
+		{name: "route", cfg: PolicyConfig{Route: "/metrics", Claims: map[string][]string{"groups": {"ops"}}}},
+		{name: "provider and route", cfg: PolicyConfig{Provider: "netbox", Route: "/metrics", Clients: []string{"alice"}}, wantErr: true},
+		{name: "no provider or route", cfg: PolicyConfig{Clients: []string{"alice"}}, wantErr: true},
+		{name: "no clients or claims", cfg: PolicyConfig{Provider: "netbox"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newPolicy(tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("newPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	a, err := New(Config{
+		Clients: []ClientConfig{
+			{Name: "alice", APIKey: "alice-key", Providers: map[string][]string{"netbox": {"prod"}}},
+			{Name: "bob", APIKey: "bob-key"},
+		},
+		Policies: []PolicyConfig{
+			{Provider: "netbox", Clients: []string{"bob"}, Targets: []string{"https://netbox.lab.example/"}},
+			{Provider: "demo", Clients: []string{AnyClient}},
+			{Provider: "netbox", Claims: map[string][]string{"groups": {"netops"}}},
+			{Route: "/metrics", Clients: []string{"carol"}, Claims: map[string][]string{"team": {"monitoring"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &Client{Name: "alice", Method: "api_key"}
+	bob := &Client{Name: "bob", Method: "api_key"}
+	netops := &Client{Name: "dave", Method: "jwt", Claims: map[string]interface{}{"groups": []interface{}{"guests", "netops"}}}
+	carol := &Client{Name: "carol", Method: "jwt", Claims: map[string]interface{}{"team": "monitoring"}}
+	carolOtherTeam := &Client{Name: "carol", Method: "jwt", Claims: map[string]interface{}{"team": "dev"}}
+
+	tests := []struct {
+		name      string
+		client    *Client
+		route     string
+		provider  string
+		wantOK    bool
+		requested string
+		target    string
+		allowed   bool
+	}{
+		{name: "client providers alias", client: alice, provider: "netbox", wantOK: true,
+			requested: "prod", target: "https://netbox.prod.example", allowed: true},
+		{name: "client providers other target", client: alice, provider: "netbox", wantOK: true,
+			requested: "https://netbox.lab.example", target: "https://netbox.lab.example", allowed: false},
+		{name: "policy target with slash", client: bob, provider: "netbox", wantOK: true,
+			requested: "lab", target: "https://netbox.lab.example", allowed: true},
+		{name: "policy other target", client: bob, provider: "netbox", wantOK: true,
+			requested: "prod", target: "https://netbox.prod.example", allowed: false},
+		{name: "any client all targets", client: bob, provider: "demo", wantOK: true,
+			requested: "https://demo.example", target: "https://demo.example", allowed: true},
+		{name: "no policy", client: alice, provider: "other", wantOK: false},
+		{name: "claim policy all targets", client: netops, provider: "netbox", wantOK: true,
+			requested: "https://netbox.lab.example", target: "https://netbox.lab.example", allowed: true},
+		{name: "any client with claims", client: netops, provider: "demo", wantOK: true,
+			requested: "https://demo.example", target: "https://demo.example", allowed: true},
+		{name: "route clients and claims", client: carol, route: "/metrics", wantOK: true},
+		{name: "route claim not matched", client: carolOtherTeam, route: "/metrics", wantOK: false},
+		{name: "route not provider", client: bob, route: "/metrics", wantOK: false},
+		{name: "provider policy not for route", client: bob, route: "/demo/", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access, ok := a.authorize(tt.client, tt.route, tt.provider)
+			if ok != tt.wantOK {
+				t.Fatalf("authorize() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok || tt.target == "" {
+				return
+			}
+			if got := access.Allowed(tt.requested, tt.target); got != tt.allowed {
+				t.Errorf("Allowed(%q, %q) = %v, want %v", tt.requested, tt.target, got, tt.allowed)
+			}
+		})
+	}
+
+	if !a.HasRoute("/metrics") || a.HasRoute("/status") {
+		t.Errorf("HasRoute(/metrics) = %v, HasRoute(/status) = %v, want true false", a.HasRoute("/metrics"), a.HasRoute("/status"))
+	}
+}
+
+func TestClaimMatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		claim interface{}
+		want  bool
+	}{
+		{name: "string", claim: "netops", want: true},
+		{name: "other string", claim: "guests", want: false},
+		{name: "list", claim: []interface{}{"guests", "netops"}, want: true},
+		{name: "list without value", claim: []interface{}{"guests"}, want: false},
+		{name: "list of numbers", claim: []interface{}{1.0}, want: false},
+		{name: "number", claim: 1.0, want: false},
+		{name: "missing", claim: nil, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := claimMatches(tt.claim, []string{"netops", "admins"}); got != tt.want {
+				t.Errorf("claimMatches(%v) = %v, want %v", tt.claim, got, tt.want)
+			}
+		})
+	}
+}
@@ -5,10 +5,32 @@ const (
 )
 
 type ConfigProxy struct {
-	ProxyLimit int   `mapstructure:"proxy_limit"`
-	CacheUse   bool  `mapstructure:"use_cache"`
-	CacheTTL   int64 `mapstructure:"cache_ttl"`
-	CacheGrace int64 `mapstructure:"cache_grace"`
-	CacheSize  int   `mapstructure:"cache_size"`
+	ProxyLimit int   `mapstructure:"proxy_limit" json:"proxy_limit"`
+	CacheUse   bool  `mapstructure:"use_cache" json:"use_cache"`
+	CacheTTL   int64 `mapstructure:"cache_ttl" json:"cache_ttl"`
+	CacheGrace int64 `mapstructure:"cache_grace" json:"cache_grace"`
+	CacheSize  int   `mapstructure:"cache_size" json:"cache_size"`
+	// CacheMaxBytes is the max estimated size in bytes of all cache entries, 0 is no limit
+	CacheMaxBytes int64 `mapstructure:"cache_max_bytes" json:"cache_max_bytes"`
+	// CacheStaleIfError is the time after grace an expired entry is kept and served if the upstream fetch fail
+	CacheStaleIfError int64 `mapstructure:"cache_stale_if_error" json:"cache_stale_if_error"`
+	// CacheNegativeTTL is the time upstream error responses are cached, 0 is no caching of errors
+	CacheNegativeTTL int64 `mapstructure:"cache_negative_ttl" json:"cache_negative_ttl"`
+	// CacheNoCacheToken if set, only requests with the token may force a refetch with Cache-Control
+	CacheNoCacheToken string `mapstructure:"cache_no_cache_token" json:"cache_no_cache_token,omitempty"`
+	// AllowedTargets are the upstream base URLs, or patterns with *, allowed in X-Forwarded-Host. If both
+	// AllowedTargets and TargetAliases are empty any target is allowed.
+	AllowedTargets []string `mapstructure:"allowed_targets" json:"allowed_targets"`
+	// TargetAliases maps a name used in X-Forwarded-Host to an upstream base URL
+	TargetAliases map[string]string `mapstructure:"target_aliases" json:"target_aliases"`
+	// UpstreamCredentials maps a target, base URL or alias or * for all, to the Authorization header sent
+	// to it instead of the one from the client
+	UpstreamCredentials map[string]string `mapstructure:"upstream_credentials" json:"upstream_credentials,omitempty"`
+	// UpstreamCredentialsFile is a file with one target=authorization per line, added to UpstreamCredentials
+	UpstreamCredentialsFile string `mapstructure:"upstream_credentials_file" json:"upstream_credentials_file,omitempty"`
+	// WarmupRequests are target=path requests fetched into the cache at start, e.g. prod=/api/dcim/devices/
+	WarmupRequests []string `mapstructure:"warmup_requests" json:"warmup_requests"`
+	// ProbePath is the path requested on each target to check that it is reachable
+	ProbePath string `mapstructure:"probe_path" json:"probe_path"`
 	//ServerAddress string `mapstructure:"server_address"`
 }
@@ -51,3 +51,28 @@ func GetEnvAsSlice(name string, defaultVal []string, sep string) []string {
 
 	return val
 }
+
+// GetEnvAsMap reads a list of key=value pairs separated by sep, e.g. prod=https://a,lab=https://b
+func GetEnvAsMap(name string, defaultVal map[string]string, sep string) map[string]string {
+	valStr := GetEnv(name, "")
+
+	if valStr == "" {
+		return defaultVal
+	}
+
+	val := make(map[string]string)
+	for _, pair := range strings.Split(valStr, sep) {
+		key, value, _ := strings.Cut(pair, "=")
+		val[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return val
+}
+
+func GetEnvAsFloat64(name string, defaultVal float64) float64 {
+	valueStr := GetEnv(name, "")
+	if value, err := strconv.ParseFloat(valueStr, 64); err == nil {
+		return value
+	}
+	return defaultVal
+}
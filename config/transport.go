@@ -0,0 +1,38 @@
+package config
+
+// ConfigTransport is the HTTP transport configuration of a provider for the upstream requests. Zero values
+// keep the defaults of http.DefaultTransport.
+type ConfigTransport struct {
+	// CAFile is a PEM bundle of CAs trusted in addition to the system CAs
+	CAFile string `mapstructure:"ca_file" yaml:"ca_file"`
+	// CertFile and KeyFile is the PEM client certificate and key
+	CertFile           string `mapstructure:"cert_file" yaml:"cert_file"`
+	KeyFile            string `mapstructure:"key_file" yaml:"key_file"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+	// Timeouts in seconds
+	DialTimeout           int64 `mapstructure:"dial_timeout" yaml:"dial_timeout"`
+	TLSHandshakeTimeout   int64 `mapstructure:"tls_handshake_timeout" yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout int64 `mapstructure:"response_header_timeout" yaml:"response_header_timeout"`
+	IdleConnTimeout       int64 `mapstructure:"idle_conn_timeout" yaml:"idle_conn_timeout"`
+	MaxIdleConns          int   `mapstructure:"max_idle_conns" yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost   int   `mapstructure:"max_idle_conns_per_host" yaml:"max_idle_conns_per_host"`
+	// Proxy is the URL of the outbound HTTP proxy, if empty HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used
+	Proxy string `mapstructure:"proxy" yaml:"proxy"`
+}
+
+// GetTransportFromEnv reads the transport configuration from the <prefix>_* environment variables
+func GetTransportFromEnv(prefix string) ConfigTransport {
+	return ConfigTransport{
+		CAFile:                GetEnv(prefix+"_TLS_CA_FILE", ""),
+		CertFile:              GetEnv(prefix+"_TLS_CERT_FILE", ""),
+		KeyFile:               GetEnv(prefix+"_TLS_KEY_FILE", ""),
+		InsecureSkipVerify:    GetEnvAsBool(prefix+"_TLS_INSECURE_SKIP_VERIFY", false),
+		DialTimeout:           GetEnvAsInt64(prefix+"_DIAL_TIMEOUT", 0),
+		TLSHandshakeTimeout:   GetEnvAsInt64(prefix+"_TLS_HANDSHAKE_TIMEOUT", 0),
+		ResponseHeaderTimeout: GetEnvAsInt64(prefix+"_RESPONSE_HEADER_TIMEOUT", 0),
+		IdleConnTimeout:       GetEnvAsInt64(prefix+"_IDLE_CONN_TIMEOUT", 0),
+		MaxIdleConns:          GetEnvAsInt(prefix+"_MAX_IDLE_CONNS", 0),
+		MaxIdleConnsPerHost:   GetEnvAsInt(prefix+"_MAX_IDLE_CONNS_PER_HOST", 0),
+		Proxy:                 GetEnv(prefix+"_HTTP_PROXY", ""),
+	}
+}
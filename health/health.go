@@ -0,0 +1,271 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"web_proxy_cache/config"
+	"web_proxy_cache/provider/common"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HealthzPath = "/healthz"
+	ReadyzPath  = "/readyz"
+	StatusPath  = "/status"
+)
+
+// warmupRetryInterval is the time between the retries of failed warmup requests
+const warmupRetryInterval = 30 * time.Second
+
+// redacted replaces secrets in the status page
+const redacted = "REDACTED"
+
+// Config is the readiness configuration
+type Config struct {
+	// RequireWarmup makes the proxy not ready until all warmup requests succeeded once
+	RequireWarmup bool
+	// ProbeUpstreams makes the proxy not ready if the last probe of any target failed
+	ProbeUpstreams bool
+	// ProbeInterval is the time between the probes of the targets
+	ProbeInterval time.Duration
+	Version       string
+}
+
+// Checker serves the health, readiness and status endpoints of the providers
+type Checker struct {
+	cfg      Config
+	started  time.Time
+	handlers map[string]*common.Handler
+
+	warm atomic.Bool
+
+	mu     sync.RWMutex
+	probed bool
+	// probes is the last probe error per provider and target, an empty string is a successful probe
+	probes map[string]map[string]string
+}
+
+// New validates the configuration and creates the checker for the provider handlers keyed by route prefix
+func New(cfg Config, handlers map[string]*common.Handler) (*Checker, error) {
+	if cfg.ProbeUpstreams && cfg.ProbeInterval <= 0 {
+		return nil, fmt.Errorf("probe interval must be positive")
+	}
+	return &Checker{cfg: cfg, started: time.Now(), handlers: handlers, probes: make(map[string]map[string]string)}, nil
+}
+
+// Run sends the warmup requests, retried until they all succeed, and probes the targets every probe
+// interval if enabled, until ctx is done
+func (c *Checker) Run(ctx context.Context) {
+	go c.runWarmup(ctx)
+	if !c.cfg.ProbeUpstreams {
+		return
+	}
+	ticker := time.NewTicker(c.cfg.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		c.probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Checker) runWarmup(ctx context.Context) {
+	pending := make(map[string]*common.Handler)
+	for _, handler := range c.handlers {
+		if handler.HasWarmup() {
+			pending[handler.Provider().Name()] = handler
+		}
+	}
+	for {
+		for name, handler := range pending {
+			start := time.Now()
+			if err := handler.Warmup(ctx); err != nil {
+				log.WithFields(log.Fields{"operation": "warmup", "proxy": name, "error": err}).
+					Error("Warmup failed")
+				continue
+			}
+			log.WithFields(log.Fields{"operation": "warmup", "proxy": name, "exectime": time.Since(start).Milliseconds()}).
+				Info("Warmup done")
+			delete(pending, name)
+		}
+		if len(pending) == 0 {
+			c.warm.Store(true)
+			return
+		}
+		timer := time.NewTimer(warmupRetryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Checker) probe(ctx context.Context) {
+	probes := make(map[string]map[string]string)
+	for _, handler := range c.handlers {
+		name := handler.Provider().Name()
+		probes[name] = make(map[string]string)
+		for target, err := range handler.Probe(ctx) {
+			probes[name][target] = ""
+			if err != nil {
+				probes[name][target] = err.Error()
+				log.WithFields(log.Fields{"operation": "probe", "proxy": name, "target": target, "error": err}).
+					Warn("Upstream probe failed")
+			}
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probes = probes
+	c.probed = true
+}
+
+// notReady returns the reasons the proxy is not ready, empty if ready
+func (c *Checker) notReady() []string {
+	var reasons []string
+	if c.cfg.RequireWarmup && !c.warm.Load() {
+		reasons = append(reasons, "warmup not done")
+	}
+	if c.cfg.ProbeUpstreams {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		if !c.probed {
+			reasons = append(reasons, "upstreams not probed yet")
+		}
+		for name, targets := range c.probes {
+			for target, err := range targets {
+				if err != "" {
+					reasons = append(reasons, fmt.Sprintf("%s %s: %s", name, target, err))
+				}
+			}
+		}
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// Healthz answers ok as long as the process serves requests
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// Readyz answers ok if the proxy is ready, otherwise 503 with one reason per line
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if reasons := c.notReady(); len(reasons) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(reasons, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+type status struct {
+	Version       string           `json:"version"`
+	Started       time.Time        `json:"started"`
+	UptimeSeconds int64            `json:"uptime_seconds"`
+	Ready         bool             `json:"ready"`
+	NotReady      []string         `json:"not_ready,omitempty"`
+	Providers     []providerStatus `json:"providers"`
+}
+
+type providerStatus struct {
+	Name      string                    `json:"name"`
+	Path      string                    `json:"path"`
+	Config    config.ConfigProxy        `json:"config"`
+	Cache     cacheStatus               `json:"cache"`
+	Upstreams map[string]upstreamStatus `json:"upstreams"`
+}
+
+type cacheStatus struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type upstreamStatus struct {
+	LastError *common.TargetError `json:"last_error,omitempty"`
+	// Probe is ok or the error of the last probe, empty if not probed
+	Probe string `json:"probe,omitempty"`
+}
+
+// Status returns the version, uptime and the configuration, cache size and upstream errors of each provider
+func (c *Checker) Status(w http.ResponseWriter, r *http.Request) {
+	reasons := c.notReady()
+	response := status{
+		Version:       c.cfg.Version,
+		Started:       c.started,
+		UptimeSeconds: int64(time.Since(c.started).Seconds()),
+		Ready:         len(reasons) == 0,
+		NotReady:      reasons,
+		Providers:     []providerStatus{},
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for path, handler := range c.handlers {
+		name := handler.Provider().Name()
+		entries, bytes := handler.Cache().Len()
+		provider := providerStatus{
+			Name:      name,
+			Path:      path,
+			Config:    redact(handler.Provider().Config()),
+			Cache:     cacheStatus{Entries: entries, Bytes: bytes},
+			Upstreams: make(map[string]upstreamStatus),
+		}
+		for _, target := range handler.Targets() {
+			provider.Upstreams[target] = upstreamStatus{}
+		}
+		for target, targetError := range handler.LastErrors() {
+			upstream := provider.Upstreams[target]
+			upstream.LastError = &targetError
+			provider.Upstreams[target] = upstream
+		}
+		for target, err := range c.probes[name] {
+			upstream := provider.Upstreams[target]
+			upstream.Probe = err
+			if err == "" {
+				upstream.Probe = "ok"
+			}
+			provider.Upstreams[target] = upstream
+		}
+		response.Providers = append(response.Providers, provider)
+	}
+	sort.Slice(response.Providers, func(i, j int) bool {
+		return response.Providers[i].Name < response.Providers[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.WithFields(log.Fields{"operation": "status", "error": err}).Error("Encode response")
+	}
+}
+
+// redact returns the configuration without the upstream credentials and the no-cache token
+func redact(cfg config.ConfigProxy) config.ConfigProxy {
+	if cfg.CacheNoCacheToken != "" {
+		cfg.CacheNoCacheToken = redacted
+	}
+	if len(cfg.UpstreamCredentials) > 0 {
+		credentials := make(map[string]string, len(cfg.UpstreamCredentials))
+		for target := range cfg.UpstreamCredentials {
+			credentials[target] = redacted
+		}
+		cfg.UpstreamCredentials = credentials
+	}
+	return cfg
+}
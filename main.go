@@ -6,16 +6,22 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
+	"web_proxy_cache/admin"
+	"web_proxy_cache/auth"
 	config2 "web_proxy_cache/config"
+	"web_proxy_cache/health"
 	"web_proxy_cache/provider"
+	"web_proxy_cache/provider/declarative"
+	"web_proxy_cache/proxy_cache"
+	"web_proxy_cache/tlsserver"
+	"web_proxy_cache/tracing"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/segmentio/ksuid"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -23,6 +29,47 @@ var version = "undefined"
 
 var ServerAddress = config2.GetEnv("SERVER_ADDRESS", ":8080")
 
+// SnapshotDir is the directory where the cache snapshots are stored, if empty no snapshots are done
+var SnapshotDir = config2.GetEnv("CACHE_SNAPSHOT_DIR", "")
+var SnapshotInterval = config2.GetEnvAsInt64("CACHE_SNAPSHOT_INTERVAL", 300)
+
+// ProvidersConfig is the path to the YAML or JSON file with declarative providers
+var ProvidersConfig = config2.GetEnv("PROVIDERS_CONFIG", "")
+
+// AdminToken is the bearer token for the admin api, if empty the admin api is not enabled
+var AdminToken = config2.GetEnv("ADMIN_TOKEN", "")
+
+// AuthConfig is the path to the YAML or JSON file with the clients, if empty clients are not authenticated
+var AuthConfig = config2.GetEnv("AUTH_CONFIG", "")
+
+// TLS serving, enabled if the cert file is set
+var TLSConfig = tlsserver.Config{
+	CertFile:     config2.GetEnv("TLS_CERT_FILE", ""),
+	KeyFile:      config2.GetEnv("TLS_KEY_FILE", ""),
+	ClientCAFile: config2.GetEnv("TLS_CLIENT_CA_FILE", ""),
+	ClientAuth:   config2.GetEnv("TLS_CLIENT_AUTH", tlsserver.ClientAuthRequire),
+	MinVersion:   config2.GetEnv("TLS_MIN_VERSION", "1.2"),
+}
+var TLSReloadInterval = config2.GetEnvAsInt64("TLS_RELOAD_INTERVAL", 60)
+
+// AccessLogFormat is the format of the access log, json, text or combined
+var AccessLogFormat = config2.GetEnv("ACCESS_LOG_FORMAT", AccessLogText)
+
+// Readiness checks of /readyz, by default the proxy is ready as soon as it serves requests
+var HealthConfig = health.Config{
+	RequireWarmup:  config2.GetEnvAsBool("READY_REQUIRE_WARMUP", false),
+	ProbeUpstreams: config2.GetEnvAsBool("READY_PROBE_UPSTREAMS", false),
+	ProbeInterval:  time.Duration(config2.GetEnvAsInt64("READY_PROBE_INTERVAL", 30)) * time.Second,
+}
+
+// Tracing of the requests, the spans are not exported if the exporter is none
+var TracingConfig = tracing.Config{
+	Exporter:    config2.GetEnv("TRACING_EXPORTER", tracing.ExporterNone),
+	Endpoint:    config2.GetEnv("TRACING_OTLP_ENDPOINT", ""),
+	SampleRatio: config2.GetEnvAsFloat64("TRACING_SAMPLE_RATIO", 1),
+	ServiceName: config2.GetEnv("TRACING_SERVICE_NAME", tracing.Name),
+}
+
 func main() {
 
 	versionFlag := flag.Bool("v", false, "Show version")
@@ -38,23 +85,91 @@ func main() {
 		Help:    "Histogram of the time (in seconds) each request took to complete.",
 		Buckets: []float64{0.050, 0.100, 0.200, 0.500, 0.800, 1.00, 2.000, 3.000},
 	},
-		[]string{"proxy", "status"},
+		[]string{"proxy", "status", "cache"},
 	)
 
+	accessLog, err := newAccessLogger(AccessLogFormat)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid access log config")
+	}
+
+	TracingConfig.Version = version
+	shutdownTracing, err := tracing.Setup(context.Background(), TracingConfig)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid tracing config")
+	}
+
+	// Add the providers defined in the providers config file
+	if ProvidersConfig != "" {
+		providers, err := declarative.Load(ProvidersConfig)
+		if err != nil {
+			log.WithFields(log.Fields{"file": ProvidersConfig, "error": err}).Fatal("Invalid providers config")
+		}
+		for _, p := range providers {
+			if err := provider.Register(p); err != nil {
+				log.WithFields(log.Fields{"file": ProvidersConfig, "error": err}).Fatal("Invalid providers config")
+			}
+		}
+	}
+
+	// Load the clients that may call the providers
+	var authenticator *auth.Authenticator
+	if AuthConfig != "" {
+		authenticator, err = auth.Load(AuthConfig)
+		if err != nil {
+			log.WithFields(log.Fields{"file": AuthConfig, "error": err}).Fatal("Invalid auth config")
+		}
+	}
+
 	// Register each provider endpoint
 	for path, handler := range provider.Providers {
 		log.WithFields(log.Fields{"path": path}).Info("Registering provider")
-		http.Handle(path, logCall(promMonitor(handler, responseTime, path)))
+		var next http.Handler = handler
+		if authenticator != nil {
+			next = authenticator.Middleware(path, handler.Provider().Name(), next)
+		} else if handler.HasCredentials() {
+			log.WithFields(log.Fields{"path": path}).
+				Fatal("Provider has upstream credentials but clients are not authenticated, set AUTH_CONFIG")
+		}
+		http.Handle(path, accessLog.logCall(promMonitor(next, responseTime, path)))
 	}
 
-	// Setup handler for exporter metrics
-	http.Handle("/metrics", promhttp.HandlerFor(
+	// Register the admin api for the cache of each provider
+	if AdminToken != "" {
+		caches := make(map[string]*proxy_cache.Cache)
+		for _, handler := range provider.Providers {
+			caches[handler.Provider().Name()] = handler.Cache()
+		}
+		log.WithFields(log.Fields{"path": admin.Path}).Info("Registering admin api")
+		http.Handle(admin.Path, accessLog.logCall(admin.NewHandler(AdminToken, caches)))
+	}
+
+	// Setup handler for exporter metrics, authenticated if there is a policy for the route
+	var metricsHandler http.Handler = promhttp.HandlerFor(
 		prometheus.DefaultGatherer,
 		promhttp.HandlerOpts{
 			// Opt into OpenMetrics to support exemplars.
 			EnableOpenMetrics: true,
 		},
-	))
+	)
+	if authenticator != nil && authenticator.HasRoute("/metrics") {
+		metricsHandler = authenticator.Middleware("/metrics", "", metricsHandler)
+	}
+	http.Handle("/metrics", metricsHandler)
+
+	// Setup the health, readiness and status endpoints, the status is authenticated if there is a policy for the route
+	HealthConfig.Version = version
+	checker, err := health.New(HealthConfig, provider.Providers)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Invalid readiness config")
+	}
+	http.HandleFunc(health.HealthzPath, checker.Healthz)
+	http.HandleFunc(health.ReadyzPath, checker.Readyz)
+	var statusHandler http.Handler = http.HandlerFunc(checker.Status)
+	if authenticator != nil && authenticator.HasRoute(health.StatusPath) {
+		statusHandler = authenticator.Middleware(health.StatusPath, "", statusHandler)
+	}
+	http.Handle(health.StatusPath, statusHandler)
 
 	server := &http.Server{
 		//ReadTimeout: viper.GetDuration("httpserver.read_timeout") * time.Second,
@@ -62,55 +177,65 @@ func main() {
 		Addr: ServerAddress,
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// Restore the caches from the last snapshot and keep saving them on schedule
+	if SnapshotDir != "" {
+		proxy_cache.LoadSnapshots(SnapshotDir)
+		go proxy_cache.RunSnapshots(ctx, SnapshotDir, time.Duration(SnapshotInterval)*time.Second)
+	}
+
+	// Warm the caches and probe the upstreams for the readiness
+	go checker.Run(ctx)
+
+	// Serve TLS with the certificate reloaded when the files change
+	if TLSConfig.CertFile != "" {
+		reloader, err := tlsserver.New(TLSConfig)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Invalid TLS config")
+		}
+		server.TLSConfig = reloader.TLSConfig()
+		go reloader.Run(ctx, time.Duration(TLSReloadInterval)*time.Second)
+	}
+
+	// done is closed when the in-flight requests are drained, or the drain timed out
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		log.Info("Stopping proxy server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("Stopping proxy server before all requests are done")
+		}
+	}()
+
 	// Start the server and log any errors
 	//log.WithFields(log.Fields{"address": config.ServerAddress, "version": version}).Info("Starting proxy server")
-	log.WithFields(log.Fields{"address": ServerAddress, "version": version}).Info("Starting proxy server")
+	log.WithFields(log.Fields{"address": ServerAddress, "version": version, "tls": server.TLSConfig != nil}).Info("Starting proxy server")
 	//, "cache_size": config.CacheSize, "cache_ttl": config.CacheTTL, "cache_grace": config.CacheGrace}).Info("Starting proxy server")
-	err := server.ListenAndServe()
-	if err != nil {
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal("Error starting proxy server: ", err)
 	}
-}
-
-type loggingResponseWriter struct {
-	http.ResponseWriter
-	statusCode int
-	length     int
-}
-
-func logCall(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		start := time.Now()
+	// ListenAndServe returns as soon as the shutdown starts, wait for the requests to finish
+	<-done
 
-		lrw := loggingResponseWriter{ResponseWriter: w}
-		requestId := nextRequestID()
-
-		ctx := context.WithValue(r.Context(), "requestid", requestId)
-		next.ServeHTTP(&lrw, r.WithContext(ctx)) // call original
-
-		w.Header().Set("Content-Length", strconv.Itoa(lrw.length))
-		log.WithFields(log.Fields{
-			"method":    r.Method,
-			"uri":       r.RequestURI,
-			"fabric":    r.URL.Query().Get("target"),
-			"status":    lrw.statusCode,
-			"length":    lrw.length,
-			"requestid": requestId,
-			"exec_time": time.Since(start).Microseconds(),
-		}).Info("api call")
-	})
-}
-func nextRequestID() ksuid.KSUID {
-	return ksuid.New()
-}
+	// Save the caches so they can be restored on next start
+	if SnapshotDir != "" {
+		proxy_cache.SaveSnapshots(SnapshotDir)
+	}
 
-func promMonitor(next http.Handler, ops *prometheus.HistogramVec, endpoint string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		lrw := loggingResponseWriter{ResponseWriter: w}
-		next.ServeHTTP(&lrw, r) // call original
-		response := time.Since(start).Seconds()
-		ops.With(prometheus.Labels{"proxy": strings.ReplaceAll(endpoint, "/", ""), "status": strconv.Itoa(lrw.statusCode)}).Observe(response)
-	})
+	// Export the remaining spans
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Stopping tracing")
+	}
 }
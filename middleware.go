@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"web_proxy_cache/proxy_cache"
+	"web_proxy_cache/requestid"
+	"web_proxy_cache/tracing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Access log formats
+const (
+	AccessLogJSON     = "json"
+	AccessLogText     = "text"
+	AccessLogCombined = "combined"
+)
+
+// loggingResponseWriter records the status, the size and the time to first byte of the response
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	start      time.Time
+	statusCode int
+	length     int
+	firstByte  time.Duration
+}
+
+// wrapResponseWriter returns w if it already is a loggingResponseWriter so all middlewares share one
+func wrapResponseWriter(w http.ResponseWriter) *loggingResponseWriter {
+	if lrw, ok := w.(*loggingResponseWriter); ok {
+		return lrw
+	}
+	return &loggingResponseWriter{ResponseWriter: w, start: time.Now()}
+}
+
+func (lrw *loggingResponseWriter) WriteHeader(statusCode int) {
+	if lrw.statusCode == 0 {
+		lrw.statusCode = statusCode
+		lrw.firstByte = time.Since(lrw.start)
+	}
+	lrw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
+	if lrw.statusCode == 0 {
+		lrw.WriteHeader(http.StatusOK)
+	}
+	n, err := lrw.ResponseWriter.Write(b)
+	lrw.length += n
+	return n, err
+}
+
+func (lrw *loggingResponseWriter) Flush() {
+	if flusher, ok := lrw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the original writer for http.ResponseController
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
+
+// status returns the status code, 200 if the handler did not write anything
+func (lrw *loggingResponseWriter) status() int {
+	if lrw.statusCode == 0 {
+		return http.StatusOK
+	}
+	return lrw.statusCode
+}
+
+// accessLogger writes the access log in one of the formats
+type accessLogger struct {
+	format string
+	logger *log.Logger
+	out    io.Writer
+}
+
+func newAccessLogger(format string) (*accessLogger, error) {
+	a := &accessLogger{format: format, logger: log.New(), out: os.Stdout}
+	a.logger.SetOutput(os.Stdout)
+	switch format {
+	case AccessLogJSON:
+		a.logger.SetFormatter(&log.JSONFormatter{})
+	case AccessLogText:
+		a.logger.SetFormatter(&log.TextFormatter{})
+	case AccessLogCombined:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q, must be %s, %s or %s", format, AccessLogJSON, AccessLogText, AccessLogCombined)
+	}
+	return a, nil
+}
+
+func (a *accessLogger) logCall(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lrw := wrapResponseWriter(w)
+		// Use the id of the client, or of a load balancer in front, so the logs can be correlated
+		requestId := r.Header.Get(requestid.Header)
+		if !requestid.Valid(requestId) {
+			requestId = requestid.New()
+		}
+		r.Header.Del(requestid.Header)
+		lrw.Header().Set(requestid.Header, requestId)
+
+		// The span of the request is a child of the incoming traceparent, if any
+		route := r.Pattern
+		if route == "" {
+			route = r.URL.Path
+		}
+		ctx, span := tracing.Tracer().Start(tracing.Extract(r.Context(), r.Header), r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(r.RemoteAddr),
+				semconv.UserAgentOriginal(r.UserAgent()),
+				attribute.String("request.id", requestId),
+			))
+		ctx = requestid.NewContext(ctx, requestId)
+		// The auth middleware removes the Authorization header, read the user before
+		user, _, _ := r.BasicAuth()
+		next.ServeHTTP(lrw, r.WithContext(ctx)) // call original
+
+		span.SetAttributes(
+			semconv.HTTPResponseStatusCode(lrw.status()),
+			semconv.HTTPResponseBodySize(lrw.length),
+			attribute.String("cache.result", proxy_cache.CacheResult(lrw.Header())),
+		)
+		if lrw.status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(lrw.status()))
+		}
+		span.End()
+
+		if a.format == AccessLogCombined {
+			a.writeCombined(r, lrw, user)
+			return
+		}
+		fields := log.Fields{
+			"method":    r.Method,
+			"uri":       r.RequestURI,
+			"fabric":    r.URL.Query().Get("target"),
+			"status":    lrw.status(),
+			"length":    lrw.length,
+			"requestid": requestId,
+			"exec_time": time.Since(lrw.start).Microseconds(),
+			"ttfb":      lrw.firstByte.Microseconds(),
+			"cache":     proxy_cache.CacheResult(lrw.Header()),
+			"remote":    r.RemoteAddr,
+		}
+		if traceID := tracing.TraceID(ctx); traceID != "" {
+			fields["traceid"] = traceID
+		}
+		a.logger.WithFields(fields).Info("api call")
+	})
+}
+
+// writeCombined writes the Apache combined log format line of the request, user is the basic auth user
+func (a *accessLogger) writeCombined(r *http.Request, lrw *loggingResponseWriter, user string) {
+	host := r.RemoteAddr
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		host = host[:i]
+	}
+	length := "-"
+	if lrw.length > 0 {
+		length = strconv.Itoa(lrw.length)
+	}
+	fmt.Fprintf(a.out, "%s - %s [%s] \"%s %s %s\" %d %s %q %q\n",
+		host, orDash(user), lrw.start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, r.RequestURI, r.Proto, lrw.status(), length,
+		orDash(r.Referer()), orDash(r.UserAgent()))
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func promMonitor(next http.Handler, ops *prometheus.HistogramVec, endpoint string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lrw := wrapResponseWriter(w)
+		start := time.Now()
+		next.ServeHTTP(lrw, r) // call original
+		response := time.Since(start).Seconds()
+		tracing.Observe(r.Context(), ops.With(prometheus.Labels{
+			"proxy":  strings.ReplaceAll(endpoint, "/", ""),
+			"status": strconv.Itoa(lrw.status()),
+			"cache":  proxy_cache.CacheResult(lrw.Header()),
+		}), response)
+	})
+}
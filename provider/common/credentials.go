@@ -0,0 +1,103 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// AnyTarget is the credentials key used for all targets without their own credentials
+const AnyTarget = "*"
+
+// Credentials are the upstream Authorization header values held by the proxy, per target
+type Credentials struct {
+	byTarget map[string]string
+}
+
+// NewCredentials creates the credentials from values and the file, both keyed by target base URL, alias
+// or *. The file has one target=authorization per line, e.g. prod=Token 0123456789abcdef. Credentials
+// require allowed targets or aliases, otherwise a client could send them to any host.
+func NewCredentials(values map[string]string, file string, targets *Targets) (*Credentials, error) {
+	all := make(map[string]string)
+	for key, value := range values {
+		all[key] = value
+	}
+	if file != "" {
+		fromFile, err := readCredentialsFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range fromFile {
+			all[key] = value
+		}
+	}
+
+	var errs []error
+	credentials := &Credentials{byTarget: make(map[string]string)}
+	for key, value := range all {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("credentials for %q are empty", key))
+			continue
+		}
+		if key == AnyTarget {
+			credentials.byTarget[AnyTarget] = value
+			continue
+		}
+		if target, ok := targets.aliases[key]; ok {
+			credentials.byTarget[target] = value
+			continue
+		}
+		target, err := normalizeTarget(key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("credentials for %q: %w", key, err))
+			continue
+		}
+		credentials.byTarget[target] = value
+	}
+	if len(credentials.byTarget) > 0 && (targets.AllowAll() || targets.Empty()) {
+		errs = append(errs, fmt.Errorf("upstream credentials require allowed targets or target aliases, not %s", AnyTarget))
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return credentials, nil
+}
+
+// Authorization returns the Authorization header value for the resolved target
+func (c *Credentials) Authorization(target string) (string, bool) {
+	if value, ok := c.byTarget[target]; ok {
+		return value, true
+	}
+	value, ok := c.byTarget[AnyTarget]
+	return value, ok
+}
+
+// Len returns the number of targets with credentials
+func (c *Credentials) Len() int {
+	return len(c.byTarget)
+}
+
+func readCredentialsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected target=authorization", path, line)
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return values, scanner.Err()
+}
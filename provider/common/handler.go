@@ -0,0 +1,295 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"web_proxy_cache/auth"
+	"web_proxy_cache/proxy_cache"
+	"web_proxy_cache/requestid"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Handler is the shared request pipeline for a Provider
+type Handler struct {
+	provider    Provider
+	prefix      string
+	cache       *proxy_cache.Cache
+	targets     *Targets
+	credentials *Credentials
+	warmup      []WarmupRequest
+	// transport is used for the probes of the targets
+	transport http.RoundTripper
+
+	mu           sync.Mutex
+	targetErrors map[string]TargetError
+}
+
+// NewHandler creates the handler and the cache for the provider
+func NewHandler(provider Provider) *Handler {
+	h := &Handler{provider: provider, prefix: fmt.Sprintf("/%s/", provider.Name())}
+	if router, ok := provider.(Router); ok {
+		h.prefix = router.Prefix()
+	}
+	targets, err := NewTargets(provider.Config().AllowedTargets, provider.Config().TargetAliases)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"operation": "init", "proxy": provider.Name(), "error": err}).
+			Fatal("Invalid targets")
+	}
+	if targets.AllowAll() {
+		logrus.WithFields(logrus.Fields{"operation": "init", "proxy": provider.Name()}).
+			Warn("Allowed targets is *, any X-Forwarded-Host is allowed")
+	} else if targets.Empty() {
+		logrus.WithFields(logrus.Fields{"operation": "init", "proxy": provider.Name()}).
+			Warn("No allowed targets configured, every X-Forwarded-Host is rejected")
+	}
+	h.targets = targets
+	h.credentials, err = NewCredentials(provider.Config().UpstreamCredentials, provider.Config().UpstreamCredentialsFile, targets)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"operation": "init", "proxy": provider.Name(), "error": err}).
+			Fatal("Invalid upstream credentials")
+	}
+	h.warmup, err = ParseWarmupRequests(provider.Config().WarmupRequests, targets)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"operation": "init", "proxy": provider.Name(), "error": err}).
+			Fatal("Invalid warmup requests")
+	}
+	h.transport = http.DefaultTransport
+	if transporter, ok := provider.(Transporter); ok {
+		h.transport = transporter.Transport()
+	}
+	h.targetErrors = make(map[string]TargetError)
+	h.cache = proxy_cache.NewCache(provider.Config(), provider.Name(), h.refresh)
+	h.cache.SetDataDecoder(provider.DecodeData)
+	return h
+}
+
+// Provider returns the provider of the handler
+func (h *Handler) Provider() Provider {
+	return h.provider
+}
+
+// Prefix returns the route prefix of the handler, /<name>/ if the provider is not a Router
+func (h *Handler) Prefix() string {
+	return h.prefix
+}
+
+// Cache returns the cache of the handler
+func (h *Handler) Cache() *proxy_cache.Cache {
+	return h.cache
+}
+
+// HasCredentials returns true if the proxy hold upstream credentials for any target of the provider
+func (h *Handler) HasCredentials() bool {
+	return h.credentials.Len() > 0
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// Guard clause to check if the request method is GET
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Guard clause to check if the X-Forwarded-Host header is present in the request
+	forwardHost := r.Header.Get(ForwardedHostHeader)
+	if forwardHost == "" {
+		http.Error(w, "X-Forwarded-Host header is required", http.StatusBadRequest)
+		return
+	}
+
+	// Only allowed targets are called, an alias is replaced with its base URL
+	target, ok := h.targets.Resolve(forwardHost)
+	if !ok {
+		requestid.Log(r.Context()).WithFields(logrus.Fields{"operation": "proxy", "proxy": h.provider.Name(), "target": forwardHost}).
+			Warn("Target not allowed")
+		http.Error(w, "X-Forwarded-Host target is not allowed", http.StatusForbidden)
+		return
+	}
+	// If the client is authenticated it must be allowed to use the target
+	if access, ok := auth.AccessFromContext(r.Context()); ok && !access.Allowed(forwardHost, target) {
+		requestid.Log(r.Context()).WithFields(logrus.Fields{"operation": "auth", "proxy": h.provider.Name(), "client": access.Client.Name, "target": target}).
+			Warn("Client not allowed")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	r.Header.Set(ForwardedHostHeader, target)
+	if authorization, ok := h.credentials.Authorization(target); ok {
+		r.Header.Set("Authorization", authorization)
+	}
+
+	h.cacheHandling(w, r)
+}
+
+func (h *Handler) cacheHandling(w http.ResponseWriter, r *http.Request) {
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(h.prefix, "/"))
+
+	key := CacheKey(r)
+	var cacheData interface{}
+	// The client Cache-Control directives, the token header is not passed on to the upstream
+	directives := proxy_cache.ParseDirectives(r, h.provider.Config().CacheNoCacheToken)
+	r.Header.Del(proxy_cache.CacheTokenHeader)
+	cacheData, cacheStatus := h.cache.Lookup(r.Context(), key, directives)
+
+	if !cacheStatus.Hit {
+		// Use the cached upstream error response, if any, instead of calling the upstream again
+		var errorResponse proxy_cache.ErrorResponse
+		negative := false
+		if !directives.NoCache {
+			errorResponse, negative = h.cache.GetError(r.Context(), key)
+		}
+		if negative {
+			cacheStatus = proxy_cache.CacheStatus{Hit: true, Negative: true}
+		} else {
+			if directives.OnlyIfCached {
+				http.Error(w, "Not found in proxy_cache", http.StatusGatewayTimeout)
+				return
+			}
+			fetched, err := h.cache.Fetch(r.Context(), key, func() (proxy_cache.CacheData, error) {
+				return h.fetch(key, r)
+			})
+			if err == nil {
+				// The fetched data is served even if it was too large to be stored
+				cacheData = fetched
+				_, cacheStatus.Stored = h.cache.Info(key)
+				cacheStatus.FwdStatus = http.StatusOK
+			} else if errors.As(err, &errorResponse) {
+				cacheStatus.FwdStatus = errorResponse.Status
+			} else {
+				errorResponse = fetchErrorResponse(err)
+			}
+		}
+
+		if cacheData == nil {
+			// Serve the last good data if the upstream failed and the entry is within stale-if-error
+			staleData, stale := h.cache.GetStale(r.Context(), key)
+			if !stale || errorResponse.Status < http.StatusInternalServerError {
+				h.cache.SetHeaders(w.Header(), key, cacheStatus)
+				errorResponse.Write(w)
+				return
+			}
+			cacheData = staleData
+			// The stale data is served, not the cached error response
+			cacheStatus.Hit = false
+			cacheStatus.Negative = false
+			cacheStatus.Stale = true
+			w.Header().Set("X-Proxy-Cache-Stale", "true")
+		}
+	}
+
+	data := cacheData.(proxy_cache.CacheData).Data
+	if transformer, ok := h.provider.(Transformer); ok {
+		var err error
+		data, err = transformer.Transform(r, data)
+		if err != nil {
+			requestid.Log(r.Context()).WithFields(logrus.Fields{"operation": "transform", "proxy": h.provider.Name(), "error": err}).
+				Error("Transform failed")
+			http.Error(w, "Transform failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// create the response headers from the proxy_cache data
+	for name, values := range cacheData.(proxy_cache.CacheData).ResponseHeaders {
+
+		for _, value := range values {
+			if name != "Content-Length" && name != "Allow" {
+				w.Header().Add(name, value)
+			}
+		}
+	}
+	w.Header().Add("Allow", "GET")
+	h.cache.SetHeaders(w.Header(), key, cacheStatus)
+
+	countUsed, lastUsed, ok := h.cache.GetUsage(key)
+	if ok {
+		w.Header().Add("X-Proxy-Cache", strconv.FormatInt(countUsed, 10))
+		w.Header().Add("X-Proxy-Cache-Last-Used", lastUsed.Format("2006-01-02 15:04:05"))
+	}
+
+	// Set the status code of the original response to the status code of the proxy response
+	w.WriteHeader(http.StatusOK)
+
+	// Encode the response body to JSON and write it to the original response
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		requestid.Log(r.Context()).WithFields(logrus.Fields{"operation": "encode", "proxy": h.provider.Name(), "error": err}).
+			Error("Encode response")
+		return
+	}
+}
+
+// fetch collects the data from the provider, store it in the cache and returns it
+func (h *Handler) fetch(key string, r *http.Request) (proxy_cache.CacheData, error) {
+	cacheData, err := h.provider.Fetch(r)
+	if err != nil {
+		h.recordError(r.Header.Get(ForwardedHostHeader), err)
+		var errorResponse proxy_cache.ErrorResponse
+		if errors.As(err, &errorResponse) {
+			h.cache.SetError(r.Context(), key, errorResponse)
+		}
+		return proxy_cache.CacheData{}, err
+	}
+
+	cacheData.RequestURI = r.URL.RequestURI()
+	// The credentials are not stored with the request, the proxy credentials are set again on a grace fetch
+	cacheData.RequestHeaders = r.Header.Clone()
+	cacheData.RequestHeaders.Del("Authorization")
+	if _, ok := h.credentials.Authorization(r.Header.Get(ForwardedHostHeader)); !ok {
+		cacheData.Authorization = r.Header.Get("Authorization")
+	}
+	h.cache.Set(r.Context(), key, cacheData)
+	return cacheData, nil
+}
+
+// refresh is the grace fetch called by the cache
+func (h *Handler) refresh(key string, r *http.Request) {
+	if authorization, ok := h.credentials.Authorization(r.Header.Get(ForwardedHostHeader)); ok {
+		r.Header.Set("Authorization", authorization)
+	}
+	// An entry restored from a snapshot has no client Authorization, it is fetched again after grace
+	if CacheKey(r) != key {
+		requestid.Log(r.Context()).WithFields(logrus.Fields{"operation": "proxy", "proxy": h.provider.Name(), "key": key}).
+			Info("Skip grace fetch, the credentials of the entry are not known")
+		return
+	}
+	if _, err := h.fetch(key, r); err != nil {
+		// Keep the previous entry, it is still served until it expires
+		requestid.Log(r.Context()).WithFields(logrus.Fields{"operation": "proxy", "proxy": h.provider.Name(), "error": err}).
+			Error("pre fetch proxy_cache")
+	}
+}
+
+// fetchErrorResponse returns the response to the client for a fetch error that is not an upstream
+// error response
+func fetchErrorResponse(err error) proxy_cache.ErrorResponse {
+	var fetchError *FetchError
+	if errors.As(err, &fetchError) {
+		return proxy_cache.NewErrorResponse(fetchError.Text, fetchError.Status)
+	}
+	return proxy_cache.NewErrorResponse("Error sending proxy request", http.StatusInternalServerError)
+}
+
+// CacheKey generates a unique cache key based on the request URL and relevant headers. The Authorization
+// header is hashed so the credentials are not in logs, the admin api or snapshots.
+func CacheKey(r *http.Request) string {
+	return fmt.Sprintf("%s%s?%s-%s", r.Header.Get(ForwardedHostHeader), r.URL.Path, r.URL.RawQuery, hashAuthorization(r.Header.Get("Authorization")))
+}
+
+// hashAuthorization returns the hex SHA-256 of the Authorization header value, empty if there is none
+func hashAuthorization(authorization string) string {
+	if authorization == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(authorization))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,182 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"web_proxy_cache/proxy_cache"
+	"web_proxy_cache/requestid"
+)
+
+// probeTimeout is the max time of a probe request to a target
+const probeTimeout = 10 * time.Second
+
+// WarmupRequest is a request fetched into the cache when the proxy starts
+type WarmupRequest struct {
+	// Target is the X-Forwarded-Host value, a base URL or an alias
+	Target string
+	// Path is the upstream path and query, without the route prefix
+	Path string
+}
+
+// ParseWarmupRequests parses the target=path values, e.g. prod=/api/dcim/devices/?status=active. The
+// targets must be allowed.
+func ParseWarmupRequests(values []string, targets *Targets) ([]WarmupRequest, error) {
+	var errs []error
+	var requests []WarmupRequest
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		// The target is a base URL without query so the first = separates it from the path
+		target, path, ok := strings.Cut(value, "=")
+		if !ok || target == "" || !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("warmup request %q must be target=/path", value))
+			continue
+		}
+		if _, allowed := targets.Resolve(target); !allowed {
+			errs = append(errs, fmt.Errorf("warmup request %q: target is not allowed", value))
+			continue
+		}
+		requests = append(requests, WarmupRequest{Target: target, Path: path})
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return requests, nil
+}
+
+// TargetError is the last failed fetch from a target
+type TargetError struct {
+	Time time.Time `json:"time"`
+	// Status is the status code of the upstream response, 0 if there was no response
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error"`
+}
+
+// recordError keeps err as the last upstream error of the target
+func (h *Handler) recordError(target string, err error) {
+	targetError := TargetError{Time: time.Now(), Error: err.Error()}
+	var errorResponse proxy_cache.ErrorResponse
+	if errors.As(err, &errorResponse) {
+		targetError.Status = errorResponse.Status
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.targetErrors[target] = targetError
+}
+
+// LastErrors returns the last upstream error per target
+func (h *Handler) LastErrors() map[string]TargetError {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	lastErrors := make(map[string]TargetError, len(h.targetErrors))
+	for target, targetError := range h.targetErrors {
+		lastErrors[target] = targetError
+	}
+	return lastErrors
+}
+
+// Targets returns the configured upstream base URLs, see Targets.List
+func (h *Handler) Targets() []string {
+	return h.targets.List()
+}
+
+// Probe requests the probe path on each configured target, in parallel, and returns the error per target.
+// A response with a status below 500 is a successful probe, it shows the target is up even if the probe
+// path requires other credentials.
+func (h *Handler) Probe(ctx context.Context) map[string]error {
+	targets := h.targets.List()
+	results := make(map[string]error, len(targets))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := h.probe(ctx, target)
+			mu.Lock()
+			defer mu.Unlock()
+			results[target] = err
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func (h *Handler) probe(ctx context.Context, target string) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target+h.provider.Config().ProbePath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(requestid.Header, requestid.New())
+	if authorization, ok := h.credentials.Authorization(target); ok {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := h.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("upstream responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Warmup sends the warmup requests of the provider through the handler, so the responses are cached the
+// same way as for a client request. It returns the errors of the failed requests.
+func (h *Handler) Warmup(ctx context.Context) error {
+	var errs []error
+	for _, warmup := range h.warmup {
+		req, err := http.NewRequestWithContext(requestid.NewContext(ctx, requestid.New()), http.MethodGet,
+			h.prefix+strings.TrimPrefix(warmup.Path, "/"), nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("warmup %s %s: %w", warmup.Target, warmup.Path, err))
+			continue
+		}
+		req.Header.Set(ForwardedHostHeader, warmup.Target)
+		w := &discardResponseWriter{header: make(http.Header)}
+		h.ServeHTTP(w, req)
+		if w.status != http.StatusOK {
+			errs = append(errs, fmt.Errorf("warmup %s %s: status %d", warmup.Target, warmup.Path, w.status))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HasWarmup returns true if the provider has warmup requests
+func (h *Handler) HasWarmup() bool {
+	return len(h.warmup) > 0
+}
+
+// discardResponseWriter keeps the status of a response and discards the body
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
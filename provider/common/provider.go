@@ -0,0 +1,90 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"web_proxy_cache/config"
+	"web_proxy_cache/proxy_cache"
+)
+
+// Provider is the upstream specific part of a provider. The request guards, caching, response headers
+// and encoding is done by the shared Handler.
+type Provider interface {
+	// Name returns the name of the provider, also used as the route prefix /<name>/
+	Name() string
+	// Config returns the provider configuration
+	Config() config.ConfigProxy
+	// Fetch collects all pages from the upstream for the request. The path of the request is without the
+	// route prefix. If the upstream respond with an error status a proxy_cache.ErrorResponse should be
+	// returned as the error so it can be cached and returned to the client.
+	Fetch(r *http.Request) (proxy_cache.CacheData, error)
+	// DecodeData decodes the Data of a CacheData restored from a snapshot
+	DecodeData(raw json.RawMessage) (interface{}, error)
+}
+
+// Transformer is an optional interface for a Provider that transform the cached data before it is
+// returned to the client
+type Transformer interface {
+	// Transform returns the data to return to the client for the request
+	Transform(r *http.Request, data interface{}) (interface{}, error)
+}
+
+// Router is an optional interface for a Provider with a route prefix other than /<name>/
+type Router interface {
+	// Prefix returns the route prefix, it must start and end with a /
+	Prefix() string
+}
+
+// Transporter is an optional interface for a Provider with its own upstream transport, used to probe the
+// targets. If not implemented the http.DefaultTransport is used.
+type Transporter interface {
+	// Transport returns the transport of the upstream requests
+	Transport() http.RoundTripper
+}
+
+// FetchError is an error from a Provider fetch with the text and status returned to the client
+type FetchError struct {
+	Text   string
+	Status int
+	Err    error
+}
+
+// NewFetchError creates a FetchError
+func NewFetchError(text string, status int, err error) error {
+	return &FetchError{Text: text, Status: status, Err: err}
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Text, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// ForwardHeaders copies the request headers from the client request to the upstream request without
+// the headers only used by the proxy
+func ForwardHeaders(dst http.Header, src http.Header) {
+	for name, values := range src {
+		for _, value := range values {
+			if name != ForwardedHostHeader {
+				dst.Add(name, value)
+			}
+		}
+	}
+}
+
+// UpstreamError reads the upstream error response and return it as a proxy_cache.ErrorResponse
+func UpstreamError(resp *http.Response) error {
+	body, err := ReadResponseBody(resp)
+	if err != nil {
+		return NewFetchError("Error reading proxy response", http.StatusInternalServerError, err)
+	}
+	return proxy_cache.ErrorResponse{
+		Status: resp.StatusCode,
+		Header: http.Header{"Content-Type": resp.Header.Values("Content-Type")},
+		Body:   body,
+	}
+}
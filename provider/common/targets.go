@@ -0,0 +1,137 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ForwardedHostHeader is the request header with the upstream target, a base URL or an alias
+const ForwardedHostHeader = "X-Forwarded-Host"
+
+// Targets is the allow-list and the aliases of the upstream targets of a provider
+type Targets struct {
+	// any is set by the allowed target *, any http or https base URL is allowed
+	any      bool
+	exact    map[string]bool
+	patterns []string
+	aliases  map[string]string
+}
+
+// NewTargets validates the allowed base URLs, or patterns with *, and the aliases. If both are empty no
+// target is allowed, the allowed target * allows all targets.
+func NewTargets(allowed []string, aliases map[string]string) (*Targets, error) {
+	var errs []error
+	targets := &Targets{exact: make(map[string]bool), aliases: make(map[string]string)}
+	for _, value := range allowed {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if value == AnyTarget {
+			targets.any = true
+			continue
+		}
+		if strings.ContainsAny(value, "*?[") {
+			if _, err := path.Match(value, ""); err != nil {
+				errs = append(errs, fmt.Errorf("allowed target %q: %w", value, err))
+				continue
+			}
+			targets.patterns = append(targets.patterns, strings.TrimSuffix(value, "/"))
+			continue
+		}
+		target, err := normalizeTarget(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("allowed target %q: %w", value, err))
+			continue
+		}
+		targets.exact[target] = true
+	}
+	for name, value := range aliases {
+		if name == "" || strings.Contains(name, "://") {
+			errs = append(errs, fmt.Errorf("target alias %q must be a name, not a URL", name))
+			continue
+		}
+		target, err := normalizeTarget(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("target alias %q: %w", name, err))
+			continue
+		}
+		targets.aliases[name] = target
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return targets, nil
+}
+
+// AllowAll returns true if the allowed targets include *
+func (t *Targets) AllowAll() bool {
+	return t.any
+}
+
+// Empty returns true if no allowed targets or aliases are configured, all targets are rejected
+func (t *Targets) Empty() bool {
+	return !t.any && len(t.exact) == 0 && len(t.patterns) == 0 && len(t.aliases) == 0
+}
+
+// Resolve returns the upstream base URL of the X-Forwarded-Host value, an alias or a base URL, and if
+// the target is allowed
+func (t *Targets) Resolve(value string) (string, bool) {
+	if target, ok := t.aliases[value]; ok {
+		return target, true
+	}
+	target, err := normalizeTarget(value)
+	if err != nil {
+		return "", false
+	}
+	if t.any || t.exact[target] {
+		return target, true
+	}
+	for _, pattern := range t.patterns {
+		if matched, _ := path.Match(pattern, target); matched {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+// List returns the allowed base URLs and the base URLs of the aliases, sorted. Patterns are not included.
+func (t *Targets) List() []string {
+	unique := make(map[string]bool)
+	for target := range t.exact {
+		unique[target] = true
+	}
+	for _, target := range t.aliases {
+		unique[target] = true
+	}
+	list := make([]string, 0, len(unique))
+	for target := range unique {
+		list = append(list, target)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// normalizeTarget returns the base URL as scheme://host[:port][/path] without a trailing slash or the
+// default port of the scheme
+func normalizeTarget(value string) (string, error) {
+	target, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return "", fmt.Errorf("scheme must be http or https")
+	}
+	if target.Host == "" || target.User != nil || target.RawQuery != "" || target.Fragment != "" {
+		return "", fmt.Errorf("must be a base URL without user, query or fragment")
+	}
+	host := strings.ToLower(target.Host)
+	if port := target.Port(); (target.Scheme == "http" && port == "80") || (target.Scheme == "https" && port == "443") {
+		host = strings.TrimSuffix(host, ":"+port)
+	}
+	return fmt.Sprintf("%s://%s%s", target.Scheme, host, strings.TrimSuffix(target.Path, "/")), nil
+}
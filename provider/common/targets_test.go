@@ -0,0 +1,107 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestNewTargets(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  []string
+		aliases  map[string]string
+		wantErr  bool
+		allowAll bool
+		empty    bool
+	}{
+		{name: "none", empty: true},
+		{name: "blank", allowed: []string{" ", ""}, empty: true},
+		{name: "any", allowed: []string{"*"}, allowAll: true},
+		{name: "base URLs and patterns", allowed: []string{"https://netbox.foo.com", " https://*.lab.foo.com "}},
+		{name: "aliases only", aliases: map[string]string{"prod": "https://netbox.prod.example"}},
+		{name: "bad scheme", allowed: []string{"ftp://netbox.foo.com"}, wantErr: true},
+		{name: "no scheme", allowed: []string{"netbox.foo.com"}, wantErr: true},
+		{name: "user", allowed: []string{"https://user@netbox.foo.com"}, wantErr: true},
+		{name: "fragment", allowed: []string{"https://netbox.foo.com/#a"}, wantErr: true},
+		{name: "bad pattern", allowed: []string{"https://[a-.foo.com"}, wantErr: true},
+		{name: "alias is a URL", aliases: map[string]string{"https://prod": "https://netbox.prod.example"}, wantErr: true},
+		{name: "empty alias name", aliases: map[string]string{"": "https://netbox.prod.example"}, wantErr: true},
+		{name: "alias bad target", aliases: map[string]string{"prod": "netbox.prod.example"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets, err := NewTargets(tt.allowed, tt.aliases)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewTargets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if targets.AllowAll() != tt.allowAll || targets.Empty() != tt.empty {
+				t.Errorf("AllowAll() = %v, Empty() = %v, want %v %v", targets.AllowAll(), targets.Empty(), tt.allowAll, tt.empty)
+			}
+		})
+	}
+}
+
+func TestTargetsResolve(t *testing.T) {
+	targets, err := NewTargets(
+		[]string{"https://netbox.foo.com/", "http://netbox.test.foo.com:8080", "https://*.lab.foo.com", "https://api.foo.com/v1"},
+		map[string]string{"prod": "https://NETBOX.prod.example:443/"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, err := NewTargets(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := NewTargets([]string{"*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		targets *Targets
+		value   string
+		want    string
+		wantOK  bool
+	}{
+		{name: "exact", targets: targets, value: "https://netbox.foo.com", want: "https://netbox.foo.com", wantOK: true},
+		{name: "trailing slash", targets: targets, value: "https://netbox.foo.com/", want: "https://netbox.foo.com", wantOK: true},
+		{name: "host case", targets: targets, value: "https://NetBox.Foo.com", want: "https://netbox.foo.com", wantOK: true},
+		{name: "scheme case", targets: targets, value: "HTTPS://netbox.foo.com", want: "https://netbox.foo.com", wantOK: true},
+		{name: "default port", targets: targets, value: "https://netbox.foo.com:443", want: "https://netbox.foo.com", wantOK: true},
+		{name: "other port", targets: targets, value: "https://netbox.foo.com:8443"},
+		{name: "other scheme", targets: targets, value: "http://netbox.foo.com"},
+		{name: "port", targets: targets, value: "http://netbox.test.foo.com:8080", want: "http://netbox.test.foo.com:8080", wantOK: true},
+		{name: "without port", targets: targets, value: "http://netbox.test.foo.com"},
+		{name: "path", targets: targets, value: "https://api.foo.com/v1/", want: "https://api.foo.com/v1", wantOK: true},
+		{name: "other path", targets: targets, value: "https://api.foo.com/v2"},
+		{name: "path of allowed base URL", targets: targets, value: "https://netbox.foo.com/admin"},
+		{name: "pattern", targets: targets, value: "https://a.lab.foo.com", want: "https://a.lab.foo.com", wantOK: true},
+		{name: "pattern subdomains", targets: targets, value: "https://a.b.lab.foo.com", want: "https://a.b.lab.foo.com", wantOK: true},
+		{name: "pattern domain", targets: targets, value: "https://lab.foo.com"},
+		{name: "pattern path", targets: targets, value: "https://a.lab.foo.com/api"},
+		{name: "pattern other domain", targets: targets, value: "https://a.lab.foo.com.evil.example"},
+		{name: "alias", targets: targets, value: "prod", want: "https://netbox.prod.example", wantOK: true},
+		{name: "alias base URL", targets: targets, value: "https://netbox.prod.example"},
+		{name: "unknown alias", targets: targets, value: "lab"},
+		{name: "user", targets: targets, value: "https://netbox.foo.com@evil.example"},
+		{name: "fragment", targets: targets, value: "https://evil.example#@netbox.foo.com"},
+		{name: "query", targets: targets, value: "https://netbox.foo.com?a=1"},
+		{name: "other host", targets: targets, value: "https://evil.example"},
+		{name: "no allowed targets", targets: none, value: "https://netbox.foo.com"},
+		{name: "any", targets: all, value: "https://Evil.example:443/", want: "https://evil.example", wantOK: true},
+		{name: "any not a URL", targets: all, value: "evil.example"},
+		{name: "any bad scheme", targets: all, value: "file:///etc/passwd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.targets.Resolve(tt.value)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Resolve(%q) = %q, %v, want %q, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
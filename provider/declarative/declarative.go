@@ -0,0 +1,299 @@
+package declarative
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"web_proxy_cache/config"
+	"web_proxy_cache/health"
+	"web_proxy_cache/provider/common"
+	"web_proxy_cache/provider/pagination"
+	"web_proxy_cache/proxy_cache"
+	"web_proxy_cache/requestid"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// reservedPaths are the routes of the proxy itself, a prefix must not be one of them or below them
+var reservedPaths = []string{"/metrics", "/admin/", health.HealthzPath, health.ReadyzPath, health.StatusPath}
+
+// File is the format of the providers configuration file, YAML or JSON
+type File struct {
+	Providers []ProviderConfig `yaml:"providers"`
+}
+
+// ProviderConfig is the configuration of a declarative provider
+type ProviderConfig struct {
+	Name string `yaml:"name"`
+	// Prefix is the route prefix, default /<name>/
+	Prefix     string            `yaml:"prefix"`
+	Pagination pagination.Config `yaml:"pagination"`
+	Headers    HeaderConfig      `yaml:"headers"`
+	Cache      CacheConfig       `yaml:"cache"`
+	// Transport is the upstream HTTP transport, TLS, timeouts and proxy
+	Transport config.ConfigTransport `yaml:"transport"`
+	Targets   TargetsConfig          `yaml:"targets"`
+	// Credentials maps a target, base URL or alias or * for all, to the upstream Authorization header
+	Credentials map[string]string `yaml:"credentials"`
+	// CredentialsFile has one target=authorization per line
+	CredentialsFile string `yaml:"credentials_file"`
+	// Warmup are target=path requests fetched into the cache at start
+	Warmup []string `yaml:"warmup"`
+	// ProbePath is the path requested on each target by the readiness probe, default /
+	ProbePath string `yaml:"probe_path"`
+}
+
+// TargetsConfig are the upstream targets allowed in X-Forwarded-Host
+type TargetsConfig struct {
+	// Allowed are the upstream base URLs, or patterns with *, a single * allows all targets
+	Allowed []string `yaml:"allowed"`
+	// Aliases maps a name to an upstream base URL
+	Aliases map[string]string `yaml:"aliases"`
+}
+
+// HeaderConfig are the header pass-through rules
+type HeaderConfig struct {
+	// Forward are the request headers sent to the upstream, if empty all headers are sent
+	Forward []string `yaml:"forward"`
+	// Drop are request headers never sent to the upstream
+	Drop []string `yaml:"drop"`
+	// Response are the upstream response headers returned to the client, if empty all headers are returned
+	Response []string `yaml:"response"`
+}
+
+// CacheConfig is the cache configuration, the defaults are the same as for the compiled providers
+type CacheConfig struct {
+	TTL          *int64 `yaml:"ttl"`
+	Grace        *int64 `yaml:"grace"`
+	Size         *int   `yaml:"size"`
+	MaxBytes     int64  `yaml:"max_bytes"`
+	StaleIfError int64  `yaml:"stale_if_error"`
+	NegativeTTL  int64  `yaml:"negative_ttl"`
+	NoCacheToken string `yaml:"no_cache_token"`
+}
+
+// Provider is a provider defined in the configuration file
+type Provider struct {
+	cfg       ProviderConfig
+	collector *pagination.Collector
+	transport http.RoundTripper
+}
+
+// Load reads the providers configuration file and creates the providers. All configuration errors are
+// returned together.
+func Load(path string) ([]*Provider, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file File
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var errs []error
+	var providers []*Provider
+	names := make(map[string]bool)
+	for i, cfg := range file.Providers {
+		provider, err := New(cfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: provider %d %q: %w", path, i, cfg.Name, err))
+			continue
+		}
+		if names[cfg.Name] {
+			errs = append(errs, fmt.Errorf("%s: provider %d %q: duplicate name", path, i, cfg.Name))
+			continue
+		}
+		names[cfg.Name] = true
+		providers = append(providers, provider)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return providers, nil
+}
+
+// New validates the configuration and creates the provider
+func New(cfg ProviderConfig) (*Provider, error) {
+	var errs []error
+	if !validName.MatchString(cfg.Name) {
+		errs = append(errs, fmt.Errorf("name must match %s", validName))
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = fmt.Sprintf("/%s/", cfg.Name)
+	}
+	if !strings.HasPrefix(cfg.Prefix, "/") || !strings.HasSuffix(cfg.Prefix, "/") || cfg.Prefix == "/" {
+		errs = append(errs, fmt.Errorf("prefix %q must start and end with /", cfg.Prefix))
+	}
+	for _, path := range reservedPaths {
+		if strings.HasPrefix(cfg.Prefix, strings.TrimSuffix(path, "/")+"/") {
+			errs = append(errs, fmt.Errorf("prefix %q is reserved for %s", cfg.Prefix, path))
+		}
+	}
+	if cfg.Cache.TTL != nil && *cfg.Cache.TTL < 0 {
+		errs = append(errs, fmt.Errorf("cache ttl must not be negative"))
+	}
+	if cfg.Cache.Grace != nil && *cfg.Cache.Grace < 0 {
+		errs = append(errs, fmt.Errorf("cache grace must not be negative"))
+	}
+	if cfg.Cache.Size != nil && *cfg.Cache.Size <= 0 {
+		errs = append(errs, fmt.Errorf("cache size must be positive"))
+	}
+	if cfg.Cache.MaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("cache max_bytes must not be negative"))
+	}
+	if cfg.Cache.StaleIfError < 0 {
+		errs = append(errs, fmt.Errorf("cache stale_if_error must not be negative"))
+	}
+	if cfg.Cache.NegativeTTL < 0 {
+		errs = append(errs, fmt.Errorf("cache negative_ttl must not be negative"))
+	}
+	targets, err := common.NewTargets(cfg.Targets.Allowed, cfg.Targets.Aliases)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		if targets.Empty() {
+			errs = append(errs, fmt.Errorf("targets allowed or aliases is required, use %q to allow all targets", common.AnyTarget))
+		}
+		if _, err := common.NewCredentials(cfg.Credentials, cfg.CredentialsFile, targets); err != nil {
+			errs = append(errs, err)
+		}
+		if _, err := common.ParseWarmupRequests(cfg.Warmup, targets); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.ProbePath == "" {
+		cfg.ProbePath = "/"
+	}
+	if !strings.HasPrefix(cfg.ProbePath, "/") {
+		errs = append(errs, fmt.Errorf("probe_path %q must start with /", cfg.ProbePath))
+	}
+	transport, err := common.NewTransport(cfg.Transport)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	collector, err := pagination.NewCollector(cfg.Name, cfg.Pagination, transport)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &Provider{cfg: cfg, collector: collector, transport: transport}, nil
+}
+
+func (p *Provider) Name() string {
+	return p.cfg.Name
+}
+
+func (p *Provider) Prefix() string {
+	return p.cfg.Prefix
+}
+
+func (p *Provider) Transport() http.RoundTripper {
+	return p.transport
+}
+
+func (p *Provider) Config() config.ConfigProxy {
+	return config.ConfigProxy{
+		ProxyLimit:              p.cfg.Pagination.PageSize,
+		CacheUse:                true,
+		CacheTTL:                valueOr(p.cfg.Cache.TTL, 600),
+		CacheGrace:              valueOr(p.cfg.Cache.Grace, 300),
+		CacheSize:               valueOr(p.cfg.Cache.Size, 1000),
+		CacheMaxBytes:           p.cfg.Cache.MaxBytes,
+		CacheStaleIfError:       p.cfg.Cache.StaleIfError,
+		CacheNegativeTTL:        p.cfg.Cache.NegativeTTL,
+		CacheNoCacheToken:       p.cfg.Cache.NoCacheToken,
+		AllowedTargets:          p.cfg.Targets.Allowed,
+		TargetAliases:           p.cfg.Targets.Aliases,
+		UpstreamCredentials:     p.cfg.Credentials,
+		UpstreamCredentialsFile: p.cfg.CredentialsFile,
+		WarmupRequests:          p.cfg.Warmup,
+		ProbePath:               p.cfg.ProbePath,
+	}
+}
+
+func valueOr[T any](value *T, defaultValue T) T {
+	if value == nil {
+		return defaultValue
+	}
+	return *value
+}
+
+// DecodeData decodes the cached results restored from a snapshot
+func (p *Provider) DecodeData(raw json.RawMessage) (interface{}, error) {
+	var results []interface{}
+	if err := json.Unmarshal(raw, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Fetch collects all pages and return the results of all pages as an array
+func (p *Provider) Fetch(r *http.Request) (proxy_cache.CacheData, error) {
+	forwardHost := r.Header.Get(common.ForwardedHostHeader)
+	newUrl := fmt.Sprintf("%s%s", forwardHost, r.URL.RequestURI())
+	// The fetch may be shared with other requests, it is not canceled if the client goes away
+	proxyReq, err := http.NewRequestWithContext(context.WithoutCancel(r.Context()), r.Method, newUrl, r.Body)
+	if err != nil {
+		requestid.Log(r.Context()).WithFields(logrus.Fields{"operation": "proxy", "proxy": p.cfg.Name, "url": newUrl, "err": err}).
+			Error("creating proxy request")
+		return proxy_cache.CacheData{}, common.NewFetchError("Error creating proxy request", http.StatusInternalServerError, err)
+	}
+	common.ForwardHeaders(proxyReq.Header, filterHeaders(r.Header, p.cfg.Headers.Forward, p.cfg.Headers.Drop))
+
+	collection, err := p.collector.Collect(proxyReq)
+	if err != nil {
+		return proxy_cache.CacheData{}, err
+	}
+
+	results := collection.Results
+	if results == nil {
+		results = []interface{}{}
+	}
+	header := filterHeaders(collection.Header, p.cfg.Headers.Response, nil)
+	header.Set("Content-Encoding", "identity")
+	return proxy_cache.CacheData{
+		ResponseHeaders: header,
+		Data:            results,
+		Size:            collection.Size,
+	}, nil
+}
+
+// filterHeaders returns the headers in allow, or all if allow is empty, except the headers in drop
+func filterHeaders(header http.Header, allow []string, drop []string) http.Header {
+	filtered := http.Header{}
+	for name, values := range header {
+		if len(allow) > 0 && !containsHeader(allow, name) {
+			continue
+		}
+		if containsHeader(drop, name) {
+			continue
+		}
+		filtered[name] = values
+	}
+	return filtered
+}
+
+func containsHeader(names []string, name string) bool {
+	for _, n := range names {
+		if http.CanonicalHeaderKey(n) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -1,16 +1,18 @@
 package netbox
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 
 	"web_proxy_cache/config"
 	"web_proxy_cache/provider/common"
+	"web_proxy_cache/provider/pagination"
 	"web_proxy_cache/proxy_cache"
+	"web_proxy_cache/requestid"
 
 	"github.com/sirupsen/logrus"
 )
@@ -42,20 +44,67 @@ const (
 )
 
 var Config = config.ConfigProxy{
-	ProxyLimit: config.GetEnvAsInt("NETBOX_LIMIT", 1000),
-	CacheUse:   config.GetEnvAsBool("NETBOX_CACHE_USE", true),
-	CacheTTL:   config.GetEnvAsInt64("NETBOX_CACHE_TTL", 600),
-	CacheGrace: config.GetEnvAsInt64("NETBOX_CACHE_GRACE", 300),
-	CacheSize:  config.GetEnvAsInt("NETBOX_CACHE_SIZE", 1000),
+	ProxyLimit:        config.GetEnvAsInt("NETBOX_LIMIT", 1000),
+	CacheUse:          config.GetEnvAsBool("NETBOX_CACHE_USE", true),
+	CacheTTL:          config.GetEnvAsInt64("NETBOX_CACHE_TTL", 600),
+	CacheGrace:        config.GetEnvAsInt64("NETBOX_CACHE_GRACE", 300),
+	CacheSize:         config.GetEnvAsInt("NETBOX_CACHE_SIZE", 1000),
+	CacheMaxBytes:     config.GetEnvAsInt64("NETBOX_CACHE_MAX_BYTES", 0),
+	CacheStaleIfError: config.GetEnvAsInt64("NETBOX_CACHE_STALE_IF_ERROR", 0),
+	CacheNegativeTTL:  config.GetEnvAsInt64("NETBOX_CACHE_NEGATIVE_TTL", 0),
+	CacheNoCacheToken: config.GetEnv("NETBOX_CACHE_NO_CACHE_TOKEN", ""),
+	AllowedTargets:    config.GetEnvAsSlice("NETBOX_ALLOWED_TARGETS", nil, ","),
+	TargetAliases:     config.GetEnvAsMap("NETBOX_TARGET_ALIASES", nil, ","),
+	// The credentials are separated by ; since an Authorization value may contain a comma
+	UpstreamCredentials:     config.GetEnvAsMap("NETBOX_UPSTREAM_CREDENTIALS", nil, ";"),
+	UpstreamCredentialsFile: config.GetEnv("NETBOX_UPSTREAM_CREDENTIALS_FILE", ""),
+	WarmupRequests:          config.GetEnvAsSlice("NETBOX_WARMUP_REQUESTS", nil, ";"),
+	ProbePath:               config.GetEnv("NETBOX_PROBE_PATH", "/api/status/"),
 }
-var customTransport = http.DefaultTransport
 
-var cache map[string]*proxy_cache.Cache
+// Transport is the upstream transport configuration from the NETBOX_* environment variables
+var Transport = config.GetTransportFromEnv("NETBOX")
+
+// Pagination is the Netbox limit and offset pagination. When the first page has returned the count all
+// other offsets are known and fetched in parallel.
+var Pagination = pagination.Config{
+	Style:           pagination.StyleOffset,
+	ResultsPath:     "results",
+	CountPath:       "count",
+	PageSize:        Config.ProxyLimit,
+	Concurrency:     config.GetEnvAsInt("NETBOX_FETCH_CONCURRENCY", 4),
+	RetryMax:        config.GetEnvAsInt("NETBOX_RETRY_MAX", 3),
+	RetryMaxElapsed: config.GetEnvAsInt64("NETBOX_RETRY_MAX_ELAPSED", 30),
+}
+
+var collector *pagination.Collector
+var transport http.RoundTripper
 
 func init() {
-	cache = make(map[string]*proxy_cache.Cache)
-	cache[Netbox] = proxy_cache.NewCache(Config, Netbox, getForwardContent)
-	// Here, you can customize the transport, e.g., set timeouts or enable/disable keep-alive
+	var err error
+	transport, err = common.NewTransport(Transport)
+	if err != nil {
+		logrus.Fatal("Netbox transport: ", err)
+	}
+	collector, err = pagination.NewCollector(Netbox, Pagination, transport)
+	if err != nil {
+		logrus.Fatal("Netbox pagination: ", err)
+	}
+}
+
+// Provider is the Netbox provider
+type Provider struct{}
+
+func (Provider) Name() string {
+	return Netbox
+}
+
+func (Provider) Config() config.ConfigProxy {
+	return Config
+}
+
+func (Provider) Transport() http.RoundTripper {
+	return transport
 }
 
 type proxyResponse struct {
@@ -66,97 +115,26 @@ type proxyResponse struct {
 	//RequestHeaders  http.Header   `json:"RequestHeaders"`
 }
 
-func Endpoint(w http.ResponseWriter, r *http.Request) {
-
-	// Guard clause to check if the request method is GET
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// DecodeData decodes the cached data restored from a snapshot
+func (Provider) DecodeData(raw json.RawMessage) (interface{}, error) {
+	var response proxyResponse
+	if err := json.Unmarshal(raw, &response); err != nil {
+		return nil, err
 	}
-
-	// Guard clause to check if the X-Forwarded-Host header is present in the request
-	if r.Header.Get("X-Forwarded-Host") == "" {
-		http.Error(w, "X-Forwarded-Host header is required", http.StatusBadRequest)
-		return
-
-	}
-
-	cacheHandling(w, r)
+	return response, nil
 }
 
-func cacheHandling(w http.ResponseWriter, r *http.Request) {
-	r.URL.Path = strings.TrimPrefix(r.URL.Path, fmt.Sprintf("/%s", Netbox))
-
-	key := getCacheKey(r)
-	var cacheData interface{}
-	var ok bool
-	cacheData, ok = cache[Netbox].Get(key)
-
-	if !ok {
-		errorText, status, err := getForwardContentData(r)
-		if err != nil {
-			http.Error(w, errorText, status)
-			return
-		}
-		cacheData, ok = cache[Netbox].Get(key)
-		if !ok {
-			http.Error(w, "Not found in proxy_cache", http.StatusNotFound)
-			return
-		}
-	}
-
-	// create the response headers from the proxy_cache data
-	for name, values := range cacheData.(proxy_cache.CacheData).ResponseHeaders {
-
-		for _, value := range values {
-			if name != "Content-Length" && name != "Allow" {
-				w.Header().Add(name, value)
-			}
-		}
-	}
-	w.Header().Add("Allow", "GET")
-
-	countUsed, lastUsed, ok := cache[Netbox].GetUsage(key)
-	if ok {
-		w.Header().Add("X-Proxy-Cache", strconv.FormatInt(countUsed, 10))
-		w.Header().Add("X-Proxy-Cache-Last-Used", lastUsed.Format("2006-01-02 15:04:05"))
-	}
-
-	// Set the status code of the original response to the status code of the proxy response
-	w.WriteHeader(http.StatusOK)
-
+// Transform returns the service discovery format of the data if the request is for service discovery
+func (Provider) Transform(r *http.Request, data interface{}) (interface{}, error) {
 	// If the request is for service discovery, call the service discovery function
 	if r.Header.Get("X-Forwarded-For") == "service-discovery" {
-
-		doServiceDiscovery(w, cacheData)
-
-		return
-	}
-	// Encode the response body to JSON and write it to the original response
-	err := json.NewEncoder(w).Encode(cacheData.(proxy_cache.CacheData).Data)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-}
-
-func doServiceDiscovery(w http.ResponseWriter, cacheData interface{}) {
-	sd, err := serviceDiscovery(cacheData.(proxy_cache.CacheData).Data)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{"operation": "service-discovery", "error": err}).Error("Service discovery failed")
-		http.Error(w, "Service discovery failed", http.StatusInternalServerError)
-		return
+		return serviceDiscovery(r.Context(), data)
 	}
-	err = json.NewEncoder(w).Encode(sd)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	return
+	return data, nil
 }
 
-func serviceDiscovery(cacheData interface{}) ([]map[string]interface{}, error) {
-	logrus.WithFields(logrus.Fields{"operation": "service-discovery"}).Info("Service discovery called")
+func serviceDiscovery(ctx context.Context, cacheData interface{}) ([]map[string]interface{}, error) {
+	requestid.Log(ctx).WithFields(logrus.Fields{"operation": "service-discovery"}).Info("Service discovery called")
 
 	raw, ok := cacheData.(proxyResponse)
 	if !ok {
@@ -262,154 +240,36 @@ func flattenCustomFields(customFields map[string]interface{}) map[string]string
 	return flat
 }
 
-func getForwardContent(r *http.Request) {
-	_, _, err := getForwardContentData(r)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{"operation": "proxy", "proxy": Netbox}).
-			Error("pre fetch proxy_cache")
-		cache[Netbox].Delete(fmt.Sprintf("%s%s?%s", r.Header.Get("X-Forwarded-Host"), r.URL.Path, r.URL.RawQuery))
-	}
-}
-
-func getForwardContentData(r *http.Request) (string, int, error) {
-	// Create a new HTTP request with the same method, URL, and body as the original request
-	var result proxyResponse
-	targetURL := r.URL
+// Fetch collects all pages from Netbox using limit and offset
+func (Provider) Fetch(r *http.Request) (proxy_cache.CacheData, error) {
 	// Get the X-Forwarded-Host header from the original request and use it to construct the new URL to the target
-	forwardHost := r.Header.Get("X-Forwarded-Host")
-	limit := Config.ProxyLimit
-	offset := 0
-	var newUrl string
-	if strings.Contains(targetURL.String(), "?") {
-		newUrl = fmt.Sprintf("%s%s&limit=%d&offset=%d", forwardHost, targetURL.String(), limit, offset)
-	} else {
-		newUrl = fmt.Sprintf("%s%s?limit=%d&offset=%d", forwardHost, targetURL.String(), limit, offset)
-	}
-	proxyReq, err := http.NewRequest(r.Method, newUrl, r.Body)
+	forwardHost := r.Header.Get(common.ForwardedHostHeader)
+	newUrl := fmt.Sprintf("%s%s", forwardHost, r.URL.RequestURI())
+	// The fetch may be shared with other requests, it is not canceled if the client goes away
+	proxyReq, err := http.NewRequestWithContext(context.WithoutCancel(r.Context()), r.Method, newUrl, r.Body)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{"operation": "proxy", "url": newUrl, "err": err, "offset": 0}).
+		requestid.Log(r.Context()).WithFields(logrus.Fields{"operation": "proxy", "url": newUrl, "err": err}).
 			Error("creating proxy request")
-		return "Error creating proxy request", http.StatusInternalServerError, err
+		return proxy_cache.CacheData{}, common.NewFetchError("Error creating proxy request", http.StatusInternalServerError, err)
 	}
 
 	// Copy the RequestHeaders from the original request to the proxy request without the X-Forwarded-Host header
-	for name, values := range r.Header {
-		for _, value := range values {
-			if name != "X-Forwarded-Host" {
-				proxyReq.Header.Add(name, value)
-			}
-		}
-	}
+	common.ForwardHeaders(proxyReq.Header, r.Header)
 
-	// Send the proxy request using the custom transport
-	startTime := time.Now()
-	resp, err := customTransport.RoundTrip(proxyReq)
+	collection, err := collector.Collect(proxyReq)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{"operation": "proxy", "url": proxyReq.URL, "err": err, "offset": 0}).
-			Error("sending proxy request")
-		return "Error sending proxy request", http.StatusInternalServerError, err
-	}
-	logrus.WithFields(logrus.Fields{
-		"operation": "proxy",
-		"url":       proxyReq.URL,
-		"offset":    0,
-		"exectime":  float64(time.Since(startTime).Milliseconds()),
-		"size":      resp.ContentLength,
-	}).Info("sending proxy request")
-
-	// Check if the response status code is not OK (200) and return an error with the status code
-	// from the target response.
-	// Typical status codes are 400 for bad request, 401 for unauthorized, 403 for forbidden, 404 for not found, etc.
-	// 400 typically means that the request had bad filters or parameters.
-	if resp.StatusCode != http.StatusOK {
-		logrus.WithFields(logrus.Fields{"operation": "proxy", "url": proxyReq.URL, "offset": 0, "status": resp.StatusCode}).
-			Error("response status")
-		return "Error sending proxy request", resp.StatusCode, nil
+		return proxy_cache.CacheData{}, err
 	}
 
-	body, err := common.ReadResponseBody(resp)
-	//body, err := io.ReadAll(resp.Body) // response body is []byte
-	//_ = resp.Body.Close()
-
-	var resultTemp proxyResponse
-	if err := json.Unmarshal(body, &resultTemp); err != nil {
-		logrus.WithFields(logrus.Fields{"operation": "proxy", "url": proxyReq.URL, "offset": 0, "err": err}).
-			Error("unmarshall body")
-		return "Could not unmarshal", http.StatusInternalServerError, err
-	}
-
-	result.Count = resultTemp.Count
-	result.Results = append(result.Results, resultTemp.Results...)
-
-	countCollect := 1
-	// Run the loop until all the Data is collected based on the initial count
-	for countCollect*limit < resultTemp.Count {
-
-		proxyReq, err = http.NewRequest(r.Method, resultTemp.Next, r.Body)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{"operation": "proxy", "err": err, "offset": countCollect}).
-				Error("creating proxy request")
-			return "Error creating proxy request", http.StatusInternalServerError, err
-		}
-
-		// Copy the RequestHeaders from the original request to the proxy request without the X-Forwarded-Host header
-		for name, values := range r.Header {
-			for _, value := range values {
-				if name != "X-Forwarded-Host" {
-					proxyReq.Header.Add(name, value)
-				}
-			}
-		}
-
-		// Send the proxy request using the custom transport
-		startTime = time.Now()
-		resp, err = customTransport.RoundTrip(proxyReq)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{"operation": "proxy", "url": proxyReq.URL, "err": err, "offset": countCollect}).
-				Error("sending proxy request")
-			return "Error sending proxy request", http.StatusInternalServerError, err
-		}
-		logrus.WithFields(logrus.Fields{
-			"operation": "proxy",
-			"url":       proxyReq.URL,
-			"offset":    countCollect,
-			"exectime":  float64(time.Since(startTime).Milliseconds()),
-			"size":      resp.ContentLength,
-		}).Info("sending proxy request")
-
-		body, err = common.ReadResponseBody(resp)
-		//body, err = io.ReadAll(resp.Body) // response body is []byte
-		//_ = resp.Body.Close()
-		if err := json.Unmarshal(body, &resultTemp); err != nil {
-			logrus.WithFields(logrus.Fields{"operation": "proxy", "url": proxyReq.URL, "offset": countCollect, "err": err}).
-				Error("unmarshall body")
-			return "Could not unmarshal", http.StatusInternalServerError, err
-		}
-		result.Count = resultTemp.Count
-		result.Results = append(result.Results, resultTemp.Results...)
-		countCollect++
-	}
-
-	// Encode the response body to JSON and write it to the original response
-	//err = json.NewEncoder(w).Encode(result)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{"operation": "proxy", "url": proxyReq.URL, "err": err}).
-			Error("encode response")
-		return err.Error(), http.StatusInternalServerError, err
-	}
+	var result proxyResponse
+	result.Count, _ = pagination.LookupInt(collection.First, "count")
+	result.Results = collection.Results
 
-	resp.Header.Set("Content-Encoding", "identity")
+	collection.Header.Set("Content-Encoding", "identity")
 	cacheData := proxy_cache.CacheData{
-		RequestHeaders:  r.Header,
-		ResponseHeaders: resp.Header,
+		ResponseHeaders: collection.Header,
 		Data:            result,
+		Size:            collection.Size,
 	}
-
-	cache[Netbox].Set(getCacheKey(r), cacheData)
-	return "Success", http.StatusOK, nil
-}
-
-// getCacheKey generates a unique cache key based on the request URL and relevant headers
-func getCacheKey(r *http.Request) string {
-	return fmt.Sprintf("%s%s?%s-%s", r.Header.Get("X-Forwarded-Host"), r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization"))
+	return cacheData, nil
 }
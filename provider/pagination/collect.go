@@ -0,0 +1,282 @@
+package pagination
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"web_proxy_cache/provider/common"
+	"web_proxy_cache/requestid"
+	"web_proxy_cache/tracing"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxPages stops a collection where the upstream never return a last page
+const maxPages = 100000
+
+// Collection is the results of all pages
+type Collection struct {
+	Results []interface{}
+	// First is the decoded body of the first page
+	First interface{}
+	// Header is the response header of the last page
+	Header http.Header
+	Pages  int
+	// Size is the sum of the body size of all pages
+	Size int64
+}
+
+// Collector fetches all pages of a collection
+type Collector struct {
+	name            string
+	strategy        Strategy
+	resultsPath     string
+	concurrency     int
+	retryMax        int
+	retryMaxElapsed time.Duration
+	transport       http.RoundTripper
+}
+
+// NewCollector creates a collector for the pagination configuration of the provider name that send the
+// page requests with the transport
+func NewCollector(name string, cfg Config, transport http.RoundTripper) (*Collector, error) {
+	strategy, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RetryMax < 0 || cfg.RetryMaxElapsed < 0 {
+		return nil, fmt.Errorf("retry_max and retry_max_elapsed must not be negative")
+	}
+	return &Collector{
+		name:            name,
+		strategy:        strategy,
+		resultsPath:     cfg.ResultsPath,
+		concurrency:     cfg.Concurrency,
+		retryMax:        cfg.RetryMax,
+		retryMaxElapsed: time.Duration(cfg.RetryMaxElapsed) * time.Second,
+		transport:       transport,
+	}, nil
+}
+
+// Collect fetches all pages starting with the request r. The method and headers of r are used for all
+// page requests. If the upstream respond with an error status the error is a proxy_cache.ErrorResponse.
+// If the strategy is a Planner and the concurrency is above 1 the pages after the first are fetched in
+// parallel, the results are always in page order.
+func (c *Collector) Collect(r *http.Request) (*Collection, error) {
+	host := r.URL.Host
+	upstreamInFlight.WithLabelValues(c.name, host).Inc()
+	defer upstreamInFlight.WithLabelValues(c.name, host).Dec()
+
+	ctx, span := tracing.Tracer().Start(r.Context(), "pagination.collect", trace.WithAttributes(
+		attribute.String("proxy", c.name),
+		semconv.ServerAddress(host),
+		semconv.URLPath(r.URL.Path),
+	))
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	start := time.Now()
+	collection, err := c.collect(r)
+	tracing.Observe(ctx, upstreamCollectionDuration.WithLabelValues(c.name, host), time.Since(start).Seconds())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "collection failed")
+		return nil, err
+	}
+	tracing.Observe(ctx, upstreamCollectionPages.WithLabelValues(c.name, host), float64(collection.Pages))
+	span.SetAttributes(
+		attribute.Int("pagination.pages", collection.Pages),
+		attribute.Int("pagination.results", len(collection.Results)),
+		attribute.Int64("pagination.bytes", collection.Size),
+	)
+	return collection, nil
+}
+
+func (c *Collector) collect(r *http.Request) (*Collection, error) {
+	collection := &Collection{}
+	pageURL := c.strategy.First(r.URL)
+	seen := make(map[string]bool)
+
+	if planner, ok := c.strategy.(Planner); ok && c.concurrency > 1 {
+		page, size, err := c.fetchPage(r.Context(), r, pageURL, 0)
+		if err != nil {
+			return nil, err
+		}
+		collection.add(page, size)
+		collection.First = page.Body
+
+		urls, ok, err := planner.Remaining(pageURL, page)
+		if err != nil {
+			requestid.Log(r.Context()).WithFields(logrus.Fields{"operation": "proxy", "url": pageURL, "page": 0, "err": err}).
+				Error("next page")
+			return nil, common.NewFetchError("Could not find next page", http.StatusBadGateway, err)
+		}
+		if ok {
+			if err := c.collectParallel(r, urls, collection); err != nil {
+				return nil, err
+			}
+			return collection, nil
+		}
+		// The remaining pages are not known, continue one page at a time after the first page
+		seen[pageURL.String()] = true
+		if pageURL, err = c.next(r, pageURL, page, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	for index := collection.Pages; pageURL != nil; index++ {
+		if index >= maxPages || seen[pageURL.String()] {
+			return nil, common.NewFetchError("Pagination does not end", http.StatusBadGateway,
+				fmt.Errorf("page %d %s already fetched or too many pages", index, pageURL))
+		}
+		seen[pageURL.String()] = true
+
+		page, size, err := c.fetchPage(r.Context(), r, pageURL, index)
+		if err != nil {
+			return nil, err
+		}
+		if index == 0 {
+			collection.First = page.Body
+		}
+		collection.add(page, size)
+
+		if pageURL, err = c.next(r, pageURL, page, index); err != nil {
+			return nil, err
+		}
+	}
+	return collection, nil
+}
+
+// next returns the URL of the page after the page fetched from current, or nil if it was the last page.
+// The page requests carry the Authorization header, so a next URL with another scheme or host than the
+// request is rejected.
+func (c *Collector) next(r *http.Request, current *url.URL, page *Page, index int) (*url.URL, error) {
+	nextURL, err := c.strategy.Next(current, page)
+	if err != nil {
+		requestid.Log(r.Context()).WithFields(logrus.Fields{"operation": "proxy", "url": current, "page": index, "err": err}).
+			Error("next page")
+		return nil, common.NewFetchError("Could not find next page", http.StatusBadGateway, err)
+	}
+	if nextURL != nil && (!strings.EqualFold(nextURL.Scheme, r.URL.Scheme) || !strings.EqualFold(nextURL.Host, r.URL.Host)) {
+		err := fmt.Errorf("next page %s is not on %s://%s", nextURL.Redacted(), r.URL.Scheme, r.URL.Host)
+		requestid.Log(r.Context()).WithFields(logrus.Fields{"operation": "proxy", "url": current, "page": index, "err": err}).
+			Error("next page")
+		return nil, common.NewFetchError("Next page on another host", http.StatusBadGateway, err)
+	}
+	return nextURL, nil
+}
+
+// collectParallel fetches the pages of urls with at most concurrency requests at the same time and add
+// them to the collection in order. The first failing page cancel the other requests and fail the collection.
+func (c *Collector) collectParallel(r *http.Request, urls []*url.URL, collection *Collection) error {
+	pages := make([]*Page, len(urls))
+	sizes := make([]int64, len(urls))
+
+	group, ctx := errgroup.WithContext(r.Context())
+	group.SetLimit(c.concurrency)
+	for i, pageURL := range urls {
+		group.Go(func() error {
+			// Do not start more requests when another page already failed
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			page, size, err := c.fetchPage(ctx, r, pageURL, i+1)
+			if err != nil {
+				return err
+			}
+			pages[i] = page
+			sizes[i] = size
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
+
+	for i, page := range pages {
+		collection.add(page, sizes[i])
+	}
+	return nil
+}
+
+func (c *Collection) add(page *Page, size int64) {
+	c.Results = append(c.Results, page.Results...)
+	c.Header = page.Header
+	c.Pages++
+	c.Size += size
+}
+
+func (c *Collector) fetchPage(ctx context.Context, r *http.Request, pageURL *url.URL, index int) (*Page, int64, error) {
+	proxyReq := r.Clone(ctx)
+	if id := requestid.FromContext(ctx); id != "" {
+		proxyReq.Header.Set(requestid.Header, id)
+	}
+	proxyReq.URL = pageURL
+	proxyReq.Host = pageURL.Host
+	proxyReq.RequestURI = ""
+
+	// Send the proxy request using the custom transport
+	startTime := time.Now()
+	resp, err := c.roundTrip(ctx, proxyReq, index)
+	if err != nil && ctx.Err() != nil {
+		// Canceled since another page failed, that error is already logged
+		requestid.Log(ctx).WithFields(logrus.Fields{"operation": "proxy", "url": proxyReq.URL, "err": err, "page": index}).
+			Debug("proxy request canceled")
+		return nil, 0, err
+	}
+	if err != nil {
+		requestid.Log(ctx).WithFields(logrus.Fields{"operation": "proxy", "url": proxyReq.URL, "err": err, "page": index}).
+			Error("sending proxy request")
+		return nil, 0, common.NewFetchError("Error sending proxy request", http.StatusInternalServerError, err)
+	}
+	requestid.Log(ctx).WithFields(logrus.Fields{
+		"operation": "proxy",
+		"url":       proxyReq.URL,
+		"page":      index,
+		"exectime":  float64(time.Since(startTime).Milliseconds()),
+		"size":      resp.ContentLength,
+	}).Info("sending proxy request")
+
+	// Typical status codes are 400 for bad request, 401 for unauthorized, 403 for forbidden, 404 for not found, etc.
+	// 400 typically means that the request had bad filters or parameters.
+	if resp.StatusCode != http.StatusOK {
+		requestid.Log(ctx).WithFields(logrus.Fields{"operation": "proxy", "url": proxyReq.URL, "page": index, "status": resp.StatusCode}).
+			Error("response status")
+		return nil, 0, common.UpstreamError(resp)
+	}
+
+	body, err := common.ReadResponseBody(resp)
+	if err != nil && ctx.Err() != nil {
+		return nil, 0, err
+	}
+	if err != nil {
+		requestid.Log(ctx).WithFields(logrus.Fields{"operation": "proxy", "url": proxyReq.URL, "page": index, "err": err}).
+			Error("read body")
+		return nil, 0, common.NewFetchError("Error reading proxy response", http.StatusInternalServerError, err)
+	}
+	upstreamReceivedBytes.WithLabelValues(c.name, pageURL.Host).Add(float64(len(body)))
+
+	page := &Page{Index: index, Header: resp.Header}
+	if err := json.Unmarshal(body, &page.Body); err != nil {
+		requestid.Log(ctx).WithFields(logrus.Fields{"operation": "proxy", "url": proxyReq.URL, "page": index, "err": err}).
+			Error("unmarshall body")
+		return nil, 0, common.NewFetchError("Could not unmarshal", http.StatusInternalServerError, err)
+	}
+	page.Results, err = LookupArray(page.Body, c.resultsPath)
+	if err != nil {
+		requestid.Log(ctx).WithFields(logrus.Fields{"operation": "proxy", "url": proxyReq.URL, "page": index, "err": err}).
+			Error("results")
+		return nil, 0, common.NewFetchError("Could not find results", http.StatusInternalServerError, err)
+	}
+	return page, int64(len(body)), nil
+}
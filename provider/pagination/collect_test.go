@@ -0,0 +1,158 @@
+package pagination
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"web_proxy_cache/proxy_cache"
+)
+
+// offsetServer serves count results in pages of limit with the offset style. The handler of a page can be
+// replaced with pageHandler, by offset.
+func offsetServer(t *testing.T, count int, pageHandler func(w http.ResponseWriter, r *http.Request, offset int) bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		if pageHandler != nil && pageHandler(w, r, offset) {
+			return
+		}
+		results := []int{}
+		for i := offset; i < offset+limit && i < count; i++ {
+			results = append(results, i)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"count": count, "results": results})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func collect(t *testing.T, cfg Config, rawURL string) (*Collection, error) {
+	t.Helper()
+	collector, err := NewCollector("test", cfg, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return collector.Collect(r)
+}
+
+func checkResults(t *testing.T, collection *Collection, count int, pages int) {
+	t.Helper()
+	if collection.Pages != pages || len(collection.Results) != count {
+		t.Fatalf("Collect() = %d pages %d results, want %d pages %d results", collection.Pages, len(collection.Results), pages, count)
+	}
+	for i, result := range collection.Results {
+		if result != float64(i) {
+			t.Fatalf("result %d = %v, want %d, results %v", i, result, i, collection.Results)
+		}
+	}
+}
+
+func TestCollect(t *testing.T) {
+	srv := offsetServer(t, 7, nil)
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "sequential count", cfg: Config{ResultsPath: "results", CountPath: "count", PageSize: 2}},
+		{name: "sequential short page", cfg: Config{ResultsPath: "results", PageSize: 2}},
+		{name: "parallel", cfg: Config{ResultsPath: "results", CountPath: "count", PageSize: 2, Concurrency: 3}},
+		{name: "parallel without count", cfg: Config{ResultsPath: "results", PageSize: 2, Concurrency: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collection, err := collect(t, tt.cfg, srv.URL+"/api/dcim/devices/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkResults(t, collection, 7, 4)
+		})
+	}
+}
+
+func TestCollectParallelOrder(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	srv := offsetServer(t, 20, func(w http.ResponseWriter, r *http.Request, offset int) bool {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			current := maxInFlight.Load()
+			if n <= current || maxInFlight.CompareAndSwap(current, n) {
+				break
+			}
+		}
+		// The later pages respond first
+		if offset > 0 {
+			time.Sleep(time.Duration(20-offset) * 5 * time.Millisecond)
+		}
+		return false
+	})
+
+	collection, err := collect(t, Config{ResultsPath: "results", CountPath: "count", PageSize: 2, Concurrency: 4}, srv.URL+"/api/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResults(t, collection, 20, 10)
+	if got := maxInFlight.Load(); got > 4 {
+		t.Errorf("%d requests in flight, want at most the concurrency 4", got)
+	}
+}
+
+func TestCollectParallelFailure(t *testing.T) {
+	var mu sync.Mutex
+	requested := make(map[int]bool)
+	var canceled atomic.Int32
+	srv := offsetServer(t, 10, func(w http.ResponseWriter, r *http.Request, offset int) bool {
+		mu.Lock()
+		requested[offset] = true
+		mu.Unlock()
+		switch offset {
+		case 0:
+			return false
+		case 2:
+			// Fail once the other pages are in flight
+			time.Sleep(50 * time.Millisecond)
+			http.Error(w, "upstream failed", http.StatusInternalServerError)
+		default:
+			select {
+			case <-r.Context().Done():
+				canceled.Add(1)
+			case <-time.After(5 * time.Second):
+			}
+		}
+		return true
+	})
+
+	start := time.Now()
+	_, err := collect(t, Config{ResultsPath: "results", CountPath: "count", PageSize: 2, Concurrency: 3}, srv.URL+"/api/")
+	var errorResponse proxy_cache.ErrorResponse
+	if !errors.As(err, &errorResponse) || errorResponse.Status != http.StatusInternalServerError {
+		t.Fatalf("Collect() error = %v, want the upstream 500 response", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Collect() took %s, the other pages were not canceled", elapsed)
+	}
+
+	// Wait for the handlers to see the canceled requests
+	srv.Close()
+	if got := canceled.Load(); got != 2 {
+		t.Errorf("%d page requests canceled, want 2", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requested[8] {
+		t.Errorf("page at offset 8 was requested after the failure")
+	}
+}
@@ -0,0 +1,82 @@
+package pagination
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Lookup returns the value at the dotted path in the decoded JSON document, e.g. "data.items" or
+// "links.0.href". An empty path returns the document.
+func Lookup(doc interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return doc, true
+	}
+	current := doc
+	for _, part := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[part]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// LookupString returns the string at the path, numbers are formatted. A missing or null value returns
+// an empty string.
+func LookupString(doc interface{}, path string) (string, error) {
+	value, ok := Lookup(doc, path)
+	if !ok || value == nil {
+		return "", nil
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("value at %s is not a string", path)
+	}
+}
+
+// LookupInt returns the number at the path
+func LookupInt(doc interface{}, path string) (int, bool) {
+	value, ok := Lookup(doc, path)
+	if !ok {
+		return 0, false
+	}
+	switch v := value.(type) {
+	case float64:
+		return int(v), true
+	case string:
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// LookupArray returns the array at the path
+func LookupArray(doc interface{}, path string) ([]interface{}, error) {
+	value, ok := Lookup(doc, path)
+	if !ok || value == nil {
+		return nil, fmt.Errorf("no results at %q", path)
+	}
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("results at %q is not an array", path)
+	}
+	return array, nil
+}
@@ -0,0 +1,59 @@
+package pagination
+
+import (
+	"web_proxy_cache/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamPageDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    config.MetricsPrefix + "upstream_page_duration_seconds",
+		Help:    "Duration of each upstream page request until the response headers",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	},
+	[]string{"proxy", "host"},
+)
+
+var upstreamCollectionDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    config.MetricsPrefix + "upstream_collection_duration_seconds",
+		Help:    "Duration of fetching all pages of a collection",
+		Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	},
+	[]string{"proxy", "host"},
+)
+
+var upstreamCollectionPages = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    config.MetricsPrefix + "upstream_collection_pages",
+		Help:    "Number of pages fetched per successful collection",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	},
+	[]string{"proxy", "host"},
+)
+
+var upstreamReceivedBytes = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: config.MetricsPrefix + "upstream_received_bytes_total",
+		Help: "Bytes of the upstream response bodies",
+	},
+	[]string{"proxy", "host"},
+)
+
+var upstreamResponses = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: config.MetricsPrefix + "upstream_responses_total",
+		Help: "Upstream page responses by status code, error for connection errors",
+	},
+	[]string{"proxy", "host", "status"},
+)
+
+var upstreamInFlight = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: config.MetricsPrefix + "upstream_collections_in_flight",
+		Help: "Collections currently being fetched from the upstream",
+	},
+	[]string{"proxy", "host"},
+)
@@ -0,0 +1,358 @@
+package pagination
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Pagination styles
+const (
+	// StyleOffset use limit and offset query parameters, e.g. Netbox
+	StyleOffset = "offset"
+	// StyleNext follows the URL of the next page in the response body
+	StyleNext = "next"
+	// StyleCursor use an opaque cursor token from the response body as a query parameter
+	StyleCursor = "cursor"
+	// StylePage use a page number query parameter until the total number of pages
+	StylePage = "page"
+	// StyleLink follows the RFC 8288 Link header with rel="next"
+	StyleLink = "link"
+)
+
+// Config is the pagination configuration of a provider
+type Config struct {
+	Style string `yaml:"style"`
+	// ResultsPath is the JSON path to the results array in each page, empty if the page is the array
+	ResultsPath string `yaml:"results_path"`
+	// NextPath is the JSON path to the next page URL for style next, or the cursor token for style cursor
+	NextPath string `yaml:"next_path"`
+	// CountPath is the JSON path to the total number of results for style offset
+	CountPath string `yaml:"count_path"`
+	// TotalPagesPath is the JSON path to the total number of pages for style page
+	TotalPagesPath string `yaml:"total_pages_path"`
+	// PageSize is the number of results requested per page, 0 use the upstream default
+	PageSize int `yaml:"page_size"`
+	// LimitParam is the page size query parameter for style offset, default limit
+	LimitParam string `yaml:"limit_param"`
+	// OffsetParam is the offset query parameter for style offset, default offset
+	OffsetParam string `yaml:"offset_param"`
+	// PageParam is the page number query parameter for style page, default page
+	PageParam string `yaml:"page_param"`
+	// PageSizeParam is the page size query parameter for style page, cursor, next and link
+	PageSizeParam string `yaml:"page_size_param"`
+	// FirstPage is the number of the first page for style page, default 1
+	FirstPage int `yaml:"first_page"`
+	// CursorParam is the cursor query parameter for style cursor, default cursor
+	CursorParam string `yaml:"cursor_param"`
+	// Concurrency is the max number of pages fetched in parallel when all page URLs are known after the
+	// first page, like style offset with count_path. 0 or 1 fetch the pages one after another.
+	Concurrency int `yaml:"concurrency"`
+	// RetryMax is the max number of retries of a page request on connection errors and 5xx and 429 responses
+	RetryMax int `yaml:"retry_max"`
+	// RetryMaxElapsed is the max time in seconds to retry a page request, 0 is no limit
+	RetryMaxElapsed int64 `yaml:"retry_max_elapsed"`
+}
+
+// Page is a page returned from the upstream
+type Page struct {
+	// Index is the index of the page in the collection, starting at 0
+	Index  int
+	Header http.Header
+	// Body is the decoded JSON body
+	Body    interface{}
+	Results []interface{}
+}
+
+// Strategy decides the URL of each page
+type Strategy interface {
+	// First returns the URL of the first page from the URL of the request
+	First(base *url.URL) *url.URL
+	// Next returns the URL of the page after the page fetched from current, or nil if it was the last page
+	Next(current *url.URL, page *Page) (*url.URL, error)
+}
+
+// Planner is implemented by a Strategy that can tell the URLs of all remaining pages from the first page,
+// so they can be fetched in parallel
+type Planner interface {
+	// Remaining returns the URLs of all pages after the first page, ok is false if they can not be known
+	Remaining(first *url.URL, page *Page) (urls []*url.URL, ok bool, err error)
+}
+
+// New creates the Strategy of the configuration
+func New(cfg Config) (Strategy, error) {
+	switch cfg.Style {
+	case StyleOffset, "":
+		return &offsetStrategy{
+			limitParam:  defaultString(cfg.LimitParam, "limit"),
+			offsetParam: defaultString(cfg.OffsetParam, "offset"),
+			limit:       cfg.PageSize,
+			countPath:   cfg.CountPath,
+		}, nil
+	case StyleNext:
+		if cfg.NextPath == "" {
+			return nil, fmt.Errorf("pagination style %s requires next_path", cfg.Style)
+		}
+		return &nextStrategy{nextPath: cfg.NextPath, pageSize: pageSize(cfg)}, nil
+	case StyleCursor:
+		if cfg.NextPath == "" {
+			return nil, fmt.Errorf("pagination style %s requires next_path", cfg.Style)
+		}
+		return &cursorStrategy{
+			cursorParam: defaultString(cfg.CursorParam, "cursor"),
+			cursorPath:  cfg.NextPath,
+			pageSize:    pageSize(cfg),
+		}, nil
+	case StylePage:
+		firstPage := 1
+		if cfg.FirstPage != 0 {
+			firstPage = cfg.FirstPage
+		}
+		return &pageStrategy{
+			pageParam:      defaultString(cfg.PageParam, "page"),
+			firstPage:      firstPage,
+			totalPagesPath: cfg.TotalPagesPath,
+			pageSize:       pageSize(cfg),
+		}, nil
+	case StyleLink:
+		return &linkStrategy{pageSize: pageSize(cfg)}, nil
+	default:
+		return nil, fmt.Errorf("unknown pagination style %q", cfg.Style)
+	}
+}
+
+func defaultString(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// pageSizeParam is the optional page size query parameter used by the non offset styles
+type pageSizeParam struct {
+	param string
+	size  int
+}
+
+func pageSize(cfg Config) pageSizeParam {
+	return pageSizeParam{param: cfg.PageSizeParam, size: cfg.PageSize}
+}
+
+func (p pageSizeParam) set(query url.Values) {
+	if p.param != "" && p.size > 0 {
+		query.Set(p.param, strconv.Itoa(p.size))
+	}
+}
+
+func withQuery(u *url.URL, query url.Values) *url.URL {
+	next := *u
+	next.RawQuery = query.Encode()
+	return &next
+}
+
+// offsetStrategy request the pages with limit and offset until the total count, or a short page
+type offsetStrategy struct {
+	limitParam  string
+	offsetParam string
+	limit       int
+	countPath   string
+}
+
+func (s *offsetStrategy) First(base *url.URL) *url.URL {
+	query := base.Query()
+	if s.limit > 0 {
+		query.Set(s.limitParam, strconv.Itoa(s.limit))
+	}
+	query.Set(s.offsetParam, "0")
+	return withQuery(base, query)
+}
+
+func (s *offsetStrategy) Next(current *url.URL, page *Page) (*url.URL, error) {
+	if len(page.Results) == 0 {
+		return nil, nil
+	}
+	query := current.Query()
+	offset, _ := strconv.Atoi(query.Get(s.offsetParam))
+	offset += len(page.Results)
+
+	if s.countPath != "" {
+		count, ok := LookupInt(page.Body, s.countPath)
+		if !ok {
+			return nil, fmt.Errorf("no count at %q", s.countPath)
+		}
+		if offset >= count {
+			return nil, nil
+		}
+	} else if s.limit > 0 && len(page.Results) < s.limit {
+		return nil, nil
+	}
+
+	query.Set(s.offsetParam, strconv.Itoa(offset))
+	return withQuery(current, query), nil
+}
+
+// Remaining returns the offsets after the first page up to the count. The step is the number of results
+// in the first page since the upstream may return fewer results than the limit, e.g. Netbox MAX_PAGE_SIZE.
+func (s *offsetStrategy) Remaining(first *url.URL, page *Page) ([]*url.URL, bool, error) {
+	if s.countPath == "" {
+		return nil, false, nil
+	}
+	step := len(page.Results)
+	if step == 0 {
+		return nil, true, nil
+	}
+	count, ok := LookupInt(page.Body, s.countPath)
+	if !ok {
+		return nil, false, fmt.Errorf("no count at %q", s.countPath)
+	}
+	query := first.Query()
+	offset, _ := strconv.Atoi(query.Get(s.offsetParam))
+
+	var urls []*url.URL
+	for offset += step; offset < count; offset += step {
+		if len(urls) >= maxPages {
+			return nil, false, fmt.Errorf("count %d needs more than %d pages", count, maxPages)
+		}
+		query.Set(s.offsetParam, strconv.Itoa(offset))
+		urls = append(urls, withQuery(first, query))
+	}
+	return urls, true, nil
+}
+
+// nextStrategy follows the next page URL in the body
+type nextStrategy struct {
+	nextPath string
+	pageSize pageSizeParam
+}
+
+func (s *nextStrategy) First(base *url.URL) *url.URL {
+	query := base.Query()
+	s.pageSize.set(query)
+	return withQuery(base, query)
+}
+
+func (s *nextStrategy) Next(current *url.URL, page *Page) (*url.URL, error) {
+	next, err := LookupString(page.Body, s.nextPath)
+	if err != nil || next == "" {
+		return nil, err
+	}
+	return current.Parse(next)
+}
+
+// cursorStrategy set the cursor token from the body as a query parameter
+type cursorStrategy struct {
+	cursorParam string
+	cursorPath  string
+	pageSize    pageSizeParam
+}
+
+func (s *cursorStrategy) First(base *url.URL) *url.URL {
+	query := base.Query()
+	s.pageSize.set(query)
+	return withQuery(base, query)
+}
+
+func (s *cursorStrategy) Next(current *url.URL, page *Page) (*url.URL, error) {
+	cursor, err := LookupString(page.Body, s.cursorPath)
+	if err != nil || cursor == "" {
+		return nil, err
+	}
+	query := current.Query()
+	query.Set(s.cursorParam, cursor)
+	return withQuery(current, query), nil
+}
+
+// pageStrategy increments the page number until the total number of pages or an empty page
+type pageStrategy struct {
+	pageParam      string
+	firstPage      int
+	totalPagesPath string
+	pageSize       pageSizeParam
+}
+
+func (s *pageStrategy) First(base *url.URL) *url.URL {
+	query := base.Query()
+	query.Set(s.pageParam, strconv.Itoa(s.firstPage))
+	s.pageSize.set(query)
+	return withQuery(base, query)
+}
+
+func (s *pageStrategy) Next(current *url.URL, page *Page) (*url.URL, error) {
+	if len(page.Results) == 0 {
+		return nil, nil
+	}
+	query := current.Query()
+	number, err := strconv.Atoi(query.Get(s.pageParam))
+	if err != nil {
+		return nil, fmt.Errorf("invalid page number %q", query.Get(s.pageParam))
+	}
+	if s.totalPagesPath != "" {
+		total, ok := LookupInt(page.Body, s.totalPagesPath)
+		if !ok {
+			return nil, fmt.Errorf("no total pages at %q", s.totalPagesPath)
+		}
+		if number-s.firstPage+1 >= total {
+			return nil, nil
+		}
+	}
+	query.Set(s.pageParam, strconv.Itoa(number+1))
+	return withQuery(current, query), nil
+}
+
+// linkStrategy follows the RFC 8288 Link header with rel="next"
+type linkStrategy struct {
+	pageSize pageSizeParam
+}
+
+func (s *linkStrategy) First(base *url.URL) *url.URL {
+	query := base.Query()
+	s.pageSize.set(query)
+	return withQuery(base, query)
+}
+
+func (s *linkStrategy) Next(current *url.URL, page *Page) (*url.URL, error) {
+	for _, value := range page.Header.Values("Link") {
+		for target, rels := range parseLinks(value) {
+			for _, rel := range strings.Fields(rels) {
+				if strings.EqualFold(rel, "next") {
+					return current.Parse(target)
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// parseLinks parses a Link header value and returns the rel parameter by target
+func parseLinks(value string) map[string]string {
+	links := make(map[string]string)
+	for value != "" {
+		start := strings.Index(value, "<")
+		end := strings.Index(value, ">")
+		if start < 0 || end < start {
+			break
+		}
+		target := value[start+1 : end]
+		value = value[end+1:]
+
+		// The parameters end at the next link
+		params := value
+		if next := strings.Index(value, "<"); next >= 0 {
+			params = value[:next]
+			value = value[next:]
+		} else {
+			value = ""
+		}
+		// The comma that separates the links is not part of the last parameter
+		params = strings.TrimSuffix(strings.TrimSpace(params), ",")
+		for _, param := range strings.Split(params, ";") {
+			name, arg, found := strings.Cut(strings.TrimSpace(param), "=")
+			if found && strings.EqualFold(strings.TrimSpace(name), "rel") {
+				links[target] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	return links
+}
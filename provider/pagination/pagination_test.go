@@ -0,0 +1,372 @@
+package pagination
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func decode(t *testing.T, body string) interface{} {
+	t.Helper()
+	if body == "" {
+		return nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "default offset", cfg: Config{}},
+		{name: "next", cfg: Config{Style: StyleNext, NextPath: "next"}},
+		{name: "next without path", cfg: Config{Style: StyleNext}, wantErr: true},
+		{name: "cursor without path", cfg: Config{Style: StyleCursor}, wantErr: true},
+		{name: "page", cfg: Config{Style: StylePage}},
+		{name: "link", cfg: Config{Style: StyleLink}},
+		{name: "unknown", cfg: Config{Style: "scroll"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStrategyFirst(t *testing.T) {
+	const base = "https://netbox.example/api/dcim/devices/?site=a"
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{name: "offset", cfg: Config{Style: StyleOffset, PageSize: 50},
+			want: "https://netbox.example/api/dcim/devices/?limit=50&offset=0&site=a"},
+		{name: "offset upstream page size", cfg: Config{},
+			want: "https://netbox.example/api/dcim/devices/?offset=0&site=a"},
+		{name: "offset params", cfg: Config{Style: StyleOffset, PageSize: 10, LimitParam: "size", OffsetParam: "start"},
+			want: "https://netbox.example/api/dcim/devices/?site=a&size=10&start=0"},
+		{name: "next page size", cfg: Config{Style: StyleNext, NextPath: "next", PageSize: 100, PageSizeParam: "per_page"},
+			want: "https://netbox.example/api/dcim/devices/?per_page=100&site=a"},
+		{name: "next page size without param", cfg: Config{Style: StyleNext, NextPath: "next", PageSize: 100},
+			want: base},
+		{name: "cursor", cfg: Config{Style: StyleCursor, NextPath: "cursor"},
+			want: base},
+		{name: "page", cfg: Config{Style: StylePage},
+			want: "https://netbox.example/api/dcim/devices/?page=1&site=a"},
+		{name: "page params", cfg: Config{Style: StylePage, PageParam: "p", FirstPage: 2, PageSize: 20, PageSizeParam: "size"},
+			want: "https://netbox.example/api/dcim/devices/?p=2&site=a&size=20"},
+		{name: "link", cfg: Config{Style: StyleLink, PageSize: 25, PageSizeParam: "per_page"},
+			want: "https://netbox.example/api/dcim/devices/?per_page=25&site=a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			baseURL := mustParse(t, base)
+			if got := strategy.First(baseURL).String(); got != tt.want {
+				t.Errorf("First() = %s, want %s", got, tt.want)
+			}
+			if baseURL.String() != base {
+				t.Errorf("First() changed the base URL to %s", baseURL)
+			}
+		})
+	}
+}
+
+func TestStrategyNext(t *testing.T) {
+	offset := Config{Style: StyleOffset, PageSize: 2}
+	offsetCount := Config{Style: StyleOffset, PageSize: 2, CountPath: "count"}
+	next := Config{Style: StyleNext, NextPath: "links.next"}
+	cursor := Config{Style: StyleCursor, NextPath: "meta.cursor"}
+	page := Config{Style: StylePage}
+	pageTotal := Config{Style: StylePage, TotalPagesPath: "total_pages"}
+	pageFrom0 := Config{Style: StylePage, FirstPage: -1, TotalPagesPath: "total_pages"}
+	link := Config{Style: StyleLink}
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		current string
+		body    string
+		results int
+		link    []string
+		want    string
+		wantErr bool
+	}{
+		{name: "offset", cfg: offset, current: "https://x.example/api/?limit=2&offset=0", results: 2,
+			want: "https://x.example/api/?limit=2&offset=2"},
+		{name: "offset short page", cfg: offset, current: "https://x.example/api/?limit=2&offset=2", results: 1},
+		{name: "offset empty page", cfg: offset, current: "https://x.example/api/?limit=2&offset=2"},
+		{name: "offset fewer than limit with count", cfg: offsetCount, current: "https://x.example/api/?limit=2&offset=0",
+			body: `{"count": 5}`, results: 1, want: "https://x.example/api/?limit=2&offset=1"},
+		{name: "offset count reached", cfg: offsetCount, current: "https://x.example/api/?limit=2&offset=2",
+			body: `{"count": 4}`, results: 2},
+		{name: "offset count as string", cfg: offsetCount, current: "https://x.example/api/?limit=2&offset=2",
+			body: `{"count": "5"}`, results: 2, want: "https://x.example/api/?limit=2&offset=4"},
+		{name: "offset no count", cfg: offsetCount, current: "https://x.example/api/?limit=2&offset=0",
+			body: `{}`, results: 2, wantErr: true},
+		{name: "next absolute", cfg: next, current: "https://x.example/api/?q=1",
+			body: `{"links": {"next": "https://x.example/api/?page=2&q=1"}}`, want: "https://x.example/api/?page=2&q=1"},
+		{name: "next relative", cfg: next, current: "https://x.example/api/?q=1",
+			body: `{"links": {"next": "/api/?page=2"}}`, want: "https://x.example/api/?page=2"},
+		{name: "next null", cfg: next, current: "https://x.example/api/", body: `{"links": {"next": null}}`},
+		{name: "next missing", cfg: next, current: "https://x.example/api/", body: `{}`},
+		{name: "next not a string", cfg: next, current: "https://x.example/api/", body: `{"links": {"next": {}}}`, wantErr: true},
+		{name: "cursor", cfg: cursor, current: "https://x.example/api/?q=1",
+			body: `{"meta": {"cursor": "abc"}}`, want: "https://x.example/api/?cursor=abc&q=1"},
+		{name: "cursor replaced", cfg: cursor, current: "https://x.example/api/?cursor=abc",
+			body: `{"meta": {"cursor": "def"}}`, want: "https://x.example/api/?cursor=def"},
+		{name: "cursor number", cfg: cursor, current: "https://x.example/api/",
+			body: `{"meta": {"cursor": 1200}}`, want: "https://x.example/api/?cursor=1200"},
+		{name: "cursor empty", cfg: cursor, current: "https://x.example/api/", body: `{"meta": {"cursor": ""}}`},
+		{name: "page", cfg: page, current: "https://x.example/api/?page=1", results: 2,
+			want: "https://x.example/api/?page=2"},
+		{name: "page empty", cfg: page, current: "https://x.example/api/?page=3"},
+		{name: "page invalid number", cfg: page, current: "https://x.example/api/?page=x", results: 2, wantErr: true},
+		{name: "page total not reached", cfg: pageTotal, current: "https://x.example/api/?page=1",
+			body: `{"total_pages": 2}`, results: 2, want: "https://x.example/api/?page=2"},
+		{name: "page total reached", cfg: pageTotal, current: "https://x.example/api/?page=2",
+			body: `{"total_pages": 2}`, results: 2},
+		{name: "page total from first page", cfg: pageFrom0, current: "https://x.example/api/?page=0",
+			body: `{"total_pages": 2}`, results: 2},
+		{name: "page no total", cfg: pageTotal, current: "https://x.example/api/?page=1",
+			body: `{}`, results: 2, wantErr: true},
+		{name: "link", cfg: link, current: "https://x.example/api/?page=1",
+			link: []string{`<https://x.example/api/?page=2>; rel="next", <https://x.example/api/?page=5>; rel="last"`},
+			want: "https://x.example/api/?page=2"},
+		{name: "link relative", cfg: link, current: "https://x.example/api/?page=1",
+			link: []string{`</api/?page=2>; rel=next`}, want: "https://x.example/api/?page=2"},
+		{name: "link several rels", cfg: link, current: "https://x.example/api/?page=4",
+			link: []string{`<https://x.example/api/?page=5>; rel="next last"`}, want: "https://x.example/api/?page=5"},
+		{name: "link case", cfg: link, current: "https://x.example/api/?page=1",
+			link: []string{`<https://x.example/api/?page=2>; REL="Next"`}, want: "https://x.example/api/?page=2"},
+		{name: "link several headers", cfg: link, current: "https://x.example/api/?page=2",
+			link: []string{`<https://x.example/api/?page=1>; rel="prev"`, `<https://x.example/api/?page=3>; rel="next"`},
+			want: "https://x.example/api/?page=3"},
+		{name: "link last page", cfg: link, current: "https://x.example/api/?page=5",
+			link: []string{`<https://x.example/api/?page=4>; rel="prev", <https://x.example/api/?page=1>; rel="first"`}},
+		{name: "link no header", cfg: link, current: "https://x.example/api/?page=5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &Page{Header: http.Header{}, Body: decode(t, tt.body), Results: make([]interface{}, tt.results)}
+			for _, value := range tt.link {
+				p.Header.Add("Link", value)
+			}
+			got, err := strategy.Next(mustParse(t, tt.current), p)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Next() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("Next() = %s, want last page", got)
+				}
+				return
+			}
+			if got == nil || got.String() != tt.want {
+				t.Errorf("Next() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffsetRemaining(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		body    string
+		results int
+		want    []string
+		wantOK  bool
+		wantErr bool
+	}{
+		{name: "no count path", cfg: Config{PageSize: 2}, body: `{"count": 5}`, results: 2},
+		{name: "pages", cfg: Config{PageSize: 2, CountPath: "count"}, body: `{"count": 5}`, results: 2, wantOK: true,
+			want: []string{"https://x.example/api/?limit=2&offset=2", "https://x.example/api/?limit=2&offset=4"}},
+		{name: "upstream max page size", cfg: Config{PageSize: 10, CountPath: "count"}, body: `{"count": 5}`, results: 3, wantOK: true,
+			want: []string{"https://x.example/api/?limit=10&offset=3"}},
+		{name: "single page", cfg: Config{PageSize: 10, CountPath: "count"}, body: `{"count": 5}`, results: 5, wantOK: true},
+		{name: "empty", cfg: Config{PageSize: 10, CountPath: "count"}, body: `{"count": 0}`, wantOK: true},
+		{name: "no count", cfg: Config{PageSize: 10, CountPath: "count"}, body: `{}`, results: 5, wantErr: true},
+		{name: "too many pages", cfg: Config{PageSize: 1, CountPath: "count"}, body: `{"count": 1e9}`, results: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strategy, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first := strategy.First(mustParse(t, "https://x.example/api/"))
+			urls, ok, err := strategy.(Planner).Remaining(first, &Page{Body: decode(t, tt.body), Results: make([]interface{}, tt.results)})
+			if (err != nil) != tt.wantErr || ok != tt.wantOK {
+				t.Fatalf("Remaining() ok = %v, error = %v, want ok %v, wantErr %v", ok, err, tt.wantOK, tt.wantErr)
+			}
+			var got []string
+			for _, u := range urls {
+				got = append(got, u.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Remaining() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLinks(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  map[string]string
+	}{
+		{name: "quoted rel", value: `<https://x.example/?page=2>; rel="next"`,
+			want: map[string]string{"https://x.example/?page=2": "next"}},
+		{name: "unquoted rel", value: `<https://x.example/?page=2>;rel=next`,
+			want: map[string]string{"https://x.example/?page=2": "next"}},
+		{name: "other params", value: `<https://x.example/?page=2>; title="Page 2; next"; rel="next"; type="application/json"`,
+			want: map[string]string{"https://x.example/?page=2": "next"}},
+		{name: "several rels", value: `<https://x.example/?page=5>; rel="next last"`,
+			want: map[string]string{"https://x.example/?page=5": "next last"}},
+		{name: "several links", value: `<https://x.example/?page=1>; rel="prev", <https://x.example/?page=3>; rel="next", <https://x.example/?page=9>; rel="last"`,
+			want: map[string]string{
+				"https://x.example/?page=1": "prev",
+				"https://x.example/?page=3": "next",
+				"https://x.example/?page=9": "last",
+			}},
+		{name: "relative", value: `</api/?page=2>; rel="next"`,
+			want: map[string]string{"/api/?page=2": "next"}},
+		{name: "no rel", value: `<https://x.example/?page=2>; title="next"`, want: map[string]string{}},
+		{name: "malformed", value: `https://x.example/?page=2; rel="next"`, want: map[string]string{}},
+		{name: "empty", want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseLinks(tt.value); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLinks(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	doc := map[string]interface{}{
+		"count":   42.0,
+		"size":    "7",
+		"ratio":   2.5,
+		"name":    "devices",
+		"active":  true,
+		"next":    nil,
+		"results": []interface{}{map[string]interface{}{"id": 1.0}, map[string]interface{}{"id": 2.0}},
+		"links":   map[string]interface{}{"next": "https://x.example/?page=2"},
+	}
+
+	lookupTests := []struct {
+		path   string
+		want   interface{}
+		wantOK bool
+	}{
+		{path: "", want: doc, wantOK: true},
+		{path: "links.next", want: "https://x.example/?page=2", wantOK: true},
+		{path: "results.1.id", want: 2.0, wantOK: true},
+		{path: "results.2.id"},
+		{path: "results.-1"},
+		{path: "results.id"},
+		{path: "count.value"},
+		{path: "missing"},
+	}
+	for _, tt := range lookupTests {
+		t.Run("Lookup "+tt.path, func(t *testing.T) {
+			got, ok := Lookup(doc, tt.path)
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lookup(%q) = %v, %v, want %v, %v", tt.path, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	stringTests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "name", want: "devices"},
+		{path: "count", want: "42"},
+		{path: "ratio", want: "2.5"},
+		{path: "next"},
+		{path: "missing"},
+		{path: "active", wantErr: true},
+		{path: "links", wantErr: true},
+	}
+	for _, tt := range stringTests {
+		t.Run("LookupString "+tt.path, func(t *testing.T) {
+			got, err := LookupString(doc, tt.path)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("LookupString(%q) = %q, %v, want %q, wantErr %v", tt.path, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	intTests := []struct {
+		path   string
+		want   int
+		wantOK bool
+	}{
+		{path: "count", want: 42, wantOK: true},
+		{path: "size", want: 7, wantOK: true},
+		{path: "name"},
+		{path: "active"},
+		{path: "next"},
+		{path: "missing"},
+	}
+	for _, tt := range intTests {
+		t.Run("LookupInt "+tt.path, func(t *testing.T) {
+			got, ok := LookupInt(doc, tt.path)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("LookupInt(%q) = %d, %v, want %d, %v", tt.path, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	arrayTests := []struct {
+		path    string
+		want    int
+		wantErr bool
+	}{
+		{path: "results", want: 2},
+		{path: "links", wantErr: true},
+		{path: "next", wantErr: true},
+		{path: "missing", wantErr: true},
+	}
+	for _, tt := range arrayTests {
+		t.Run("LookupArray "+tt.path, func(t *testing.T) {
+			got, err := LookupArray(doc, tt.path)
+			if len(got) != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("LookupArray(%q) = %v, %v, want %d results, wantErr %v", tt.path, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package pagination
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"web_proxy_cache/config"
+	"web_proxy_cache/requestid"
+	"web_proxy_cache/tracing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Backoff of the retries, doubled for each retry up to retryMaxBackoff. A longer Retry-After is
+// followed up to retryMaxAfter, retry_max_elapsed is not required to bound the delay.
+const (
+	retryBaseBackoff = 500 * time.Millisecond
+	retryMaxBackoff  = 10 * time.Second
+	retryMaxAfter    = 60 * time.Second
+)
+
+var upstreamRetries = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: config.MetricsPrefix + "upstream_retries_total",
+		Help: "Retries of upstream page requests",
+	},
+	[]string{"proxy", "status"},
+)
+
+// retryable returns true for the response statuses that are worth a retry
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// backoff returns the exponential backoff with jitter before the retry attempt, starting at 1
+func backoff(attempt int) time.Duration {
+	delay := retryBaseBackoff << (attempt - 1)
+	if delay > retryMaxBackoff || delay <= 0 {
+		delay = retryMaxBackoff
+	}
+	// Equal jitter, wait between half and the full backoff
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retryAfter returns the delay of the Retry-After header, in seconds or as a HTTP date, or 0 if not set
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// retryDelay returns the delay before the retry attempt of a retryable response, the Retry-After of the
+// response up to retryMaxAfter if it is longer than the backoff
+func retryDelay(header http.Header, attempt int, now time.Time) time.Duration {
+	return max(min(retryAfter(header, now), retryMaxAfter), backoff(attempt))
+}
+
+// observeResponse records the duration and status of a page request, resp is nil on connection errors
+func observeResponse(ctx context.Context, name string, host string, resp *http.Response, duration time.Duration) {
+	tracing.Observe(ctx, upstreamPageDuration.WithLabelValues(name, host), duration.Seconds())
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	upstreamResponses.WithLabelValues(name, host, status).Inc()
+}
+
+// roundTrip sends the page request and retries connection errors and 5xx and 429 responses up to
+// retryMax times, or until retryMaxElapsed. The response of the last attempt is returned even if
+// the status is an error.
+func (c *Collector) roundTrip(ctx context.Context, req *http.Request, index int) (*http.Response, error) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		attemptStart := time.Now()
+		resp, err := c.roundTripAttempt(ctx, req, index, attempt)
+		if ctx.Err() == nil {
+			observeResponse(ctx, c.name, req.URL.Host, resp, time.Since(attemptStart))
+		}
+		if ctx.Err() != nil || attempt > c.retryMax {
+			return resp, err
+		}
+
+		var delay time.Duration
+		var status string
+		if err != nil {
+			status = "error"
+			delay = backoff(attempt)
+		} else if retryable(resp.StatusCode) {
+			status = strconv.Itoa(resp.StatusCode)
+			delay = retryDelay(resp.Header, attempt, time.Now())
+		} else {
+			return resp, nil
+		}
+
+		if c.retryMaxElapsed > 0 && time.Since(start)+delay > c.retryMaxElapsed {
+			requestid.Log(ctx).WithFields(logrus.Fields{"operation": "proxy", "url": req.URL, "page": index, "attempt": attempt}).
+				Warn("retry max elapsed time reached")
+			return resp, err
+		}
+		if resp != nil {
+			// Drain the body so the connection can be reused
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		upstreamRetries.WithLabelValues(c.name, status).Inc()
+		fields := logrus.Fields{
+			"operation": "proxy",
+			"url":       req.URL,
+			"page":      index,
+			"attempt":   attempt,
+			"status":    status,
+			"delay":     delay.Milliseconds(),
+		}
+		if err != nil {
+			fields["err"] = err
+		}
+		requestid.Log(ctx).WithFields(fields).Warn("retry proxy request")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// roundTripAttempt sends the page request in a client span and with the traceparent header of the span
+func (c *Collector) roundTripAttempt(ctx context.Context, req *http.Request, index int, attempt int) (*http.Response, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "pagination.page "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.String()),
+			semconv.ServerAddress(req.URL.Hostname()),
+			semconv.HTTPRequestResendCount(attempt-1),
+			attribute.Int("pagination.page", index),
+		))
+	defer span.End()
+
+	tracing.Inject(ctx, req.Header)
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "request failed")
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	return resp, nil
+}
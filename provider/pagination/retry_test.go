@@ -0,0 +1,143 @@
+package pagination
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"web_proxy_cache/proxy_cache"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{name: "none"},
+		{name: "seconds", value: "5", want: 5 * time.Second},
+		{name: "zero", value: "0"},
+		{name: "negative", value: "-1"},
+		{name: "date", value: "Wed, 01 May 2024 12:00:30 GMT", want: 30 * time.Second},
+		{name: "RFC 850 date", value: "Wednesday, 01-May-24 12:01:00 GMT", want: time.Minute},
+		{name: "past date", value: "Wed, 01 May 2024 11:59:00 GMT"},
+		{name: "invalid", value: "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.value != "" {
+				header.Set("Retry-After", tt.value)
+			}
+			if got := retryAfter(header, now); got != tt.want {
+				t.Errorf("retryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		retryAfter string
+		attempt    int
+		min        time.Duration
+		max        time.Duration
+	}{
+		{name: "backoff", attempt: 1, min: retryBaseBackoff / 2, max: retryBaseBackoff},
+		{name: "backoff doubled", attempt: 3, min: 2 * retryBaseBackoff, max: 4 * retryBaseBackoff},
+		{name: "max backoff", attempt: 100, min: retryMaxBackoff / 2, max: retryMaxBackoff},
+		{name: "retry after", retryAfter: "30", attempt: 1, min: 30 * time.Second, max: 30 * time.Second},
+		{name: "retry after shorter than backoff", retryAfter: "1", attempt: 10, min: retryMaxBackoff / 2, max: retryMaxBackoff},
+		{name: "retry after capped", retryAfter: "3600", attempt: 1, min: retryMaxAfter, max: retryMaxAfter},
+		{name: "retry after date capped", retryAfter: now.Add(24 * time.Hour).UTC().Format(http.TimeFormat), attempt: 1,
+			min: retryMaxAfter, max: retryMaxAfter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.retryAfter != "" {
+				header.Set("Retry-After", tt.retryAfter)
+			}
+			if got := retryDelay(header, tt.attempt, now); got < tt.min || got > tt.max {
+				t.Errorf("retryDelay(%q, %d) = %s, want between %s and %s", tt.retryAfter, tt.attempt, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        Config
+		statuses   []int
+		retryAfter func() string
+		wantStatus int
+		wantCalls  int32
+		minElapsed time.Duration
+		maxElapsed time.Duration
+	}{
+		{name: "5xx then ok", cfg: Config{RetryMax: 3}, statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway},
+			wantCalls: 3, maxElapsed: 2 * time.Second},
+		{name: "429 then ok", cfg: Config{RetryMax: 3}, statuses: []int{http.StatusTooManyRequests},
+			wantCalls: 2, maxElapsed: time.Second},
+		{name: "retry after seconds", cfg: Config{RetryMax: 3}, statuses: []int{http.StatusTooManyRequests},
+			retryAfter: func() string { return "1" }, wantCalls: 2, minElapsed: time.Second, maxElapsed: 2 * time.Second},
+		{name: "retry after date", cfg: Config{RetryMax: 3}, statuses: []int{http.StatusServiceUnavailable},
+			retryAfter: func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) },
+			wantCalls: 2, minElapsed: 900 * time.Millisecond, maxElapsed: 3 * time.Second},
+		{name: "retries exhausted", cfg: Config{RetryMax: 2},
+			statuses:   []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			wantStatus: http.StatusInternalServerError, wantCalls: 3, maxElapsed: 2 * time.Second},
+		{name: "no retries", cfg: Config{}, statuses: []int{http.StatusServiceUnavailable},
+			wantStatus: http.StatusServiceUnavailable, wantCalls: 1, maxElapsed: time.Second},
+		{name: "not retryable", cfg: Config{RetryMax: 3}, statuses: []int{http.StatusNotFound},
+			wantStatus: http.StatusNotFound, wantCalls: 1, maxElapsed: time.Second},
+		{name: "retry after beyond max elapsed", cfg: Config{RetryMax: 3, RetryMaxElapsed: 1}, statuses: []int{http.StatusTooManyRequests},
+			retryAfter: func() string { return "5" }, wantStatus: http.StatusTooManyRequests, wantCalls: 1, maxElapsed: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := offsetServer(t, 1, func(w http.ResponseWriter, r *http.Request, offset int) bool {
+				call := int(calls.Add(1))
+				if call > len(tt.statuses) {
+					return false
+				}
+				if tt.retryAfter != nil {
+					w.Header().Set("Retry-After", tt.retryAfter())
+				}
+				http.Error(w, http.StatusText(tt.statuses[call-1]), tt.statuses[call-1])
+				return true
+			})
+
+			tt.cfg.ResultsPath = "results"
+			tt.cfg.PageSize = 10
+			start := time.Now()
+			collection, err := collect(t, tt.cfg, srv.URL+"/api/")
+			elapsed := time.Since(start)
+
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("Collect() error = %v", err)
+				}
+				checkResults(t, collection, 1, 1)
+			} else {
+				var errorResponse proxy_cache.ErrorResponse
+				if !errors.As(err, &errorResponse) || errorResponse.Status != tt.wantStatus {
+					t.Fatalf("Collect() error = %v, want status %d", err, tt.wantStatus)
+				}
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("%d requests, want %d", got, tt.wantCalls)
+			}
+			if elapsed < tt.minElapsed || elapsed > tt.maxElapsed {
+				t.Errorf("Collect() took %s, want between %s and %s", elapsed, tt.minElapsed, tt.maxElapsed)
+			}
+		})
+	}
+}
@@ -2,12 +2,27 @@ package provider
 
 import (
 	"fmt"
-	"net/http"
+	"web_proxy_cache/provider/common"
 	"web_proxy_cache/provider/demo"
 	"web_proxy_cache/provider/netbox"
 )
 
-var Providers = map[string]http.HandlerFunc{
-	fmt.Sprintf("/%s/", netbox.Netbox): netbox.Endpoint,
-	fmt.Sprintf("/%s/", demo.Demo):     demo.Endpoint,
+var Providers = map[string]*common.Handler{
+	fmt.Sprintf("/%s/", netbox.Netbox): common.NewHandler(netbox.Provider{}),
+	fmt.Sprintf("/%s/", demo.Demo):     common.NewHandler(demo.Provider{}),
+}
+
+// Register adds a provider to Providers. The name and the route prefix must not already be used.
+func Register(p common.Provider) error {
+	for path, handler := range Providers {
+		if handler.Provider().Name() == p.Name() {
+			return fmt.Errorf("provider %s already registered on %s", p.Name(), path)
+		}
+	}
+	handler := common.NewHandler(p)
+	if _, exists := Providers[handler.Prefix()]; exists {
+		return fmt.Errorf("route %s of provider %s already registered", handler.Prefix(), p.Name())
+	}
+	Providers[handler.Prefix()] = handler
+	return nil
 }
@@ -1,11 +1,14 @@
 package proxy_cache
 
 import (
+	"container/list"
+	"context"
 	"net/http"
 	"net/url"
-	"sort"
 
 	"web_proxy_cache/config"
+	"web_proxy_cache/requestid"
+	"web_proxy_cache/tracing"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -14,6 +17,9 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 var cacheHits = promauto.NewCounterVec(
@@ -44,19 +50,34 @@ var cacheExpire = promauto.NewCounterVec(
 	},
 	[]string{"proxy"},
 )
+var cacheStale = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: config.MetricsPrefix + "cache_stale_total",
+		Help: "Expired cache entries served since the upstream fetch failed",
+	},
+	[]string{"proxy"},
+)
+var cacheCoalesced = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: config.MetricsPrefix + "cache_coalesced_total",
+		Help: "Cache fetches that shared an already running upstream fetch for the same key",
+	},
+	[]string{"proxy"},
+)
 
 type CacheData struct {
-	RequestHeaders  http.Header
+	// RequestURI is the path and query of the request sent to the provider, used for grace fetches
+	RequestURI string
+	// RequestHeaders are the headers of the request sent to the provider, without Authorization
+	RequestHeaders http.Header
+	// Authorization is the client Authorization header used for grace fetches. It is only kept in memory,
+	// never in snapshots.
+	Authorization   string
 	ResponseHeaders http.Header
 	Data            interface{}
-}
-
-type cacheObj struct {
-	lastUsed    time.Time
-	ttl         time.Time
-	usedCounter int64
-	graceTime   time.Time
-	cacheData   CacheData
+	// Size is the size in bytes of the data as received from the upstream. If not set the cache will
+	// estimate it from the JSON encoding of Data.
+	Size int64
 }
 
 type Element struct {
@@ -64,38 +85,50 @@ type Element struct {
 	Timestamp time.Time
 }
 
+// SortedSet is a set of elements ordered by their timestamp, oldest first. It is implemented as a
+// doubly linked list with a map from value to list element so add, remove, contains and oldest are
+// all constant time when elements are added in timestamp order, which is the case for the cache index.
 type SortedSet struct {
-	set []Element
-	mu  sync.RWMutex
+	list  *list.List
+	items map[string]*list.Element
+	mu    sync.RWMutex
+}
+
+func (s *SortedSet) init() {
+	if s.list == nil {
+		s.list = list.New()
+		s.items = make(map[string]*list.Element)
+	}
 }
 
 func (s *SortedSet) Add(element Element) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.init()
 
 	// Check if the element already exists in the set
-	for _, v := range s.set {
-		if v.Value == element.Value {
+	if _, exists := s.items[element.Value]; exists {
+		return
+	}
+
+	// Find the position from the back, normally the new element is the newest
+	for e := s.list.Back(); e != nil; e = e.Prev() {
+		if !element.Timestamp.Before(e.Value.(Element).Timestamp) {
+			s.items[element.Value] = s.list.InsertAfter(element, e)
 			return
 		}
 	}
-
-	// Add the element and sort the set
-	s.set = append(s.set, element)
-	sort.Slice(s.set, func(i, j int) bool {
-		return s.set[i].Timestamp.Before(s.set[j].Timestamp)
-	})
+	s.items[element.Value] = s.list.PushFront(element)
 }
 
 func (s *SortedSet) Remove(element Element) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.init()
 
-	for i, v := range s.set {
-		if v.Value == element.Value {
-			s.set = append(s.set[:i], s.set[i+1:]...)
-			return
-		}
+	if e, exists := s.items[element.Value]; exists {
+		s.list.Remove(e)
+		delete(s.items, element.Value)
 	}
 }
 
@@ -103,75 +136,142 @@ func (s *SortedSet) Contains(element Element) bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	for _, v := range s.set {
-		if v.Value == element.Value {
-			return true
-		}
+	_, exists := s.items[element.Value]
+	return exists
+}
+
+// Oldest returns the element with the oldest timestamp
+func (s *SortedSet) Oldest() (Element, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.list == nil || s.list.Len() == 0 {
+		return Element{}, false
 	}
-	return false
+	return s.list.Front().Value.(Element), true
 }
 
+func (s *SortedSet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.items)
+}
+
+// Elements returns a copy of all elements, oldest first
 func (s *SortedSet) Elements() []Element {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	return s.set
+	if s.list == nil {
+		return nil
+	}
+	elements := make([]Element, 0, s.list.Len())
+	for e := s.list.Front(); e != nil; e = e.Next() {
+		elements = append(elements, e.Value.(Element))
+	}
+	return elements
 }
 
 type Cache struct {
 	name     string
 	mu       sync.RWMutex
-	entries  map[string]*cacheObj
-	index    SortedSet
+	store    Store
 	maxSize  int
 	maxTTL   int64
 	maxGrace int64
+	maxBytes int64
+	maxStale int64
+	// negative keeps upstream error responses for negativeTTL seconds
+	negative    Store
+	negativeTTL int64
+	// bytes is the estimated size of all entries in the store
+	bytes int64
+	// inflight folds concurrent upstream fetches for the same key into one
+	inflight singleflight.Group
 	//fetchFunc func(w http.ResponseWriter, r *http.Request)
-	fetchFunc func(r *http.Request)
+	fetchFunc func(key string, r *http.Request)
+	decoder   DataDecoder
 }
 
 // func NewCache(config ConfigProxy, name string, fetchfunc func(w http.ResponseWriter, r *http.Request)) *Cache {
-func NewCache(config config.ConfigProxy, name string, fetchfunc func(r *http.Request)) *Cache {
-	return &Cache{
-		entries:   make(map[string]*cacheObj),
-		index:     SortedSet{},
-		maxSize:   config.CacheSize,
-		maxTTL:    config.CacheTTL,
-		maxGrace:  config.CacheGrace,
-		fetchFunc: fetchfunc,
-		name:      name,
+func NewCache(config config.ConfigProxy, name string, fetchfunc func(key string, r *http.Request)) *Cache {
+	return NewCacheWithStore(config, name, fetchfunc, NewMemoryStore())
+}
+
+// NewCacheWithStore creates a Cache that keep its entries in the given Store
+func NewCacheWithStore(config config.ConfigProxy, name string, fetchfunc func(key string, r *http.Request), store Store) *Cache {
+	cache := &Cache{
+		store:       store,
+		maxSize:     config.CacheSize,
+		maxTTL:      config.CacheTTL,
+		maxGrace:    config.CacheGrace,
+		maxBytes:    config.CacheMaxBytes,
+		maxStale:    config.CacheStaleIfError,
+		negative:    NewMemoryStore(),
+		negativeTTL: config.CacheNegativeTTL,
+		fetchFunc:   fetchfunc,
+		name:        name,
 	}
+	register(cache)
+	return cache
 }
 
-func (u *Cache) Set(key string, data CacheData) {
-	u.mu.Lock()
-	defer u.mu.Unlock()
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]*Cache)
+)
 
-	if len(u.entries) >= u.maxSize {
-		oldest := u.index.Elements()[0]
-		delete(u.entries, oldest.Value)
-		u.index.Remove(oldest)
-		log.WithFields(log.Fields{"operation": "proxy_cache", "key": oldest}).
-			Info("proxy_cache size limit reached")
+func register(cache *Cache) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[cache.name] = cache
+}
+
+// Caches returns all caches created, by name
+func Caches() map[string]*Cache {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	caches := make(map[string]*Cache, len(registry))
+	for name, cache := range registry {
+		caches[name] = cache
 	}
+	return caches
+}
+
+// Name returns the name of the cache
+func (u *Cache) Name() string {
+	return u.name
+}
+
+// Set stores the data for the key and returns true if it was stored, data larger than the max bytes of
+// the cache is not stored
+func (u *Cache) Set(ctx context.Context, key string, data CacheData) bool {
+	size := estimateSize(data)
 
-	obj := cacheObj{
-		lastUsed:    time.Time{},
-		ttl:         time.Now().Add(time.Duration(u.maxTTL) * time.Second),
-		usedCounter: 0,
-		graceTime:   time.Now().Add(time.Duration(u.maxGrace+u.maxTTL) * time.Second),
-		cacheData:   data,
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	obj := Entry{
+		Created:     time.Now(),
+		LastUsed:    time.Time{},
+		TTL:         time.Now().Add(time.Duration(u.maxTTL) * time.Second),
+		UsedCounter: 0,
+		GraceTime:   time.Now().Add(time.Duration(u.maxGrace+u.maxTTL) * time.Second),
+		StaleTime:   time.Now().Add(time.Duration(u.maxStale+u.maxGrace+u.maxTTL) * time.Second),
+		Size:        size,
+		CacheData:   data,
 	}
-	u.entries[key] = &obj
-	u.index.Add(Element{Value: key, Timestamp: time.Now()})
+	stored := u.add(ctx, key, &obj)
+	u.negative.Delete(key)
+	return stored
 }
 
 func (u *Cache) GetUsage(key string) (int64, time.Time, bool) {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
-	_, exists := u.entries[key]
-	if exists {
-		return u.entries[key].usedCounter, u.entries[key].lastUsed, true
+	if entry, exists := u.store.Get(key); exists {
+		return entry.UsedCounter, entry.LastUsed, true
 	}
 	return 0, time.Time{}, false
 }
@@ -179,79 +279,277 @@ func (u *Cache) GetUsage(key string) (int64, time.Time, bool) {
 func (u *Cache) Inc(key string) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	u.entries[key].usedCounter++
-	u.entries[key].lastUsed = time.Now()
+	if entry, exists := u.store.Get(key); exists {
+		entry.UsedCounter++
+		entry.LastUsed = time.Now()
+		u.store.Set(key, entry)
+	}
 }
 
 func (u *Cache) Exists(key string) bool {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
-	_, exists := u.entries[key]
+	_, exists := u.store.Get(key)
 
 	return exists
 }
 
-func (u *Cache) Delete(key string) {
+// Delete removes the entry and the cached error response for the key and returns true if any existed
+func (u *Cache) Delete(ctx context.Context, key string) bool {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 
-	if _, exists := u.entries[key]; exists {
-		delete(u.entries, key)
-		u.index.Remove(Element{Value: key})
-		log.WithFields(log.Fields{"operation": "proxy_cache", "key": key}).
+	removed := u.remove(key)
+	if u.negative.Delete(key) || removed {
+		requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": key}).
 			Info("proxy_cache entry removed")
+		return true
 	}
+	return false
 }
 
-func (u *Cache) Get(key string) (interface{}, bool) {
+// Fetch runs fetch for the key unless a fetch for the same key is already running, in which case
+// the caller waits for that fetch and gets its result. This makes sure that concurrent cache misses
+// on the same key only result in a single upstream collection. The fetched data is returned even if
+// it was not stored in the cache.
+func (u *Cache) Fetch(ctx context.Context, key string, fetch func() (CacheData, error)) (CacheData, error) {
+	value, err, shared := u.inflight.Do(key, func() (interface{}, error) {
+		return fetch()
+	})
+	if shared {
+		cacheCoalesced.WithLabelValues(u.name).Inc()
+		requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": key}).
+			Info("Shared upstream fetch")
+	}
+	if err != nil {
+		return CacheData{}, err
+	}
+	data, ok := value.(CacheData)
+	if !ok {
+		// A grace refresh does not return its data, fetch again
+		return fetch()
+	}
+	return data, nil
+}
 
-	u.mu.RLock()
-	//defer u.mu.Unlock()
-	if value, ok := u.entries[key]; ok {
-		u.mu.RUnlock()
-		if value.ttl.Before(time.Now()) {
-			if value.graceTime.After(time.Now()) && value.usedCounter > 0 {
-				url, _ := url.Parse(key)
-				url.Host = ""
-				url.Scheme = ""
-
-				r := &http.Request{
-					Method: http.MethodGet,
-					URL:    url,
-					Header: u.entries[key].cacheData.RequestHeaders,
-				}
-				//w := NewCustomResponseWriter()
-				go u.fetchFunc(r)
-				cacheGraceFetches.WithLabelValues(u.name).Inc()
-				log.WithFields(log.Fields{"operation": "proxy_cache", "key": key, "used": u.entries[key].usedCounter}).
-					Info("TTL expired, grace time")
-			} else {
-				u.mu.Lock()
-				delete(u.entries, key)
-				u.index.Remove(Element{Value: key})
-				u.mu.Unlock()
-				log.WithFields(log.Fields{"operation": "proxy_cache", "key": key}).
-					Info("TTL expired")
-				cacheExpire.WithLabelValues(u.name).Inc()
-				log.WithFields(log.Fields{"operation": "proxy_cache", "key": key}).
-					Info("TTL expired, entry removed")
-				return nil, false
+// refresh starts a background fetch for the key. If a fetch for the key is already running no new
+// fetch is started. The fetch has its own request id and trace, linked to the request in ctx.
+func (u *Cache) refresh(ctx context.Context, key string, r *http.Request) {
+	link := trace.LinkFromContext(ctx)
+	trigger := requestid.FromContext(ctx)
+	u.inflight.DoChan(key, func() (interface{}, error) {
+		cacheGraceFetches.WithLabelValues(u.name).Inc()
+		id := requestid.New()
+		refreshCtx, span := tracing.Tracer().Start(context.Background(), "cache.refresh",
+			trace.WithNewRoot(), trace.WithLinks(link),
+			trace.WithAttributes(
+				attribute.String("cache.name", u.name),
+				attribute.String("request.id", id),
+				attribute.String("request.trigger_id", trigger),
+			))
+		defer span.End()
+		refreshCtx = requestid.NewContext(refreshCtx, id)
+		requestid.Log(refreshCtx).WithFields(log.Fields{"operation": "proxy_cache", "key": key, "trigger": trigger}).
+			Info("Start grace refresh")
+		u.fetchFunc(key, r.WithContext(refreshCtx))
+		return nil, nil
+	})
+}
+
+func (u *Cache) Get(ctx context.Context, key string) (interface{}, bool) {
+	data, status := u.lookup(ctx, key, NoDirectives)
+	return data, status.Hit
+}
+
+// Lookup returns the data for the key if it is accepted by the client Cache-Control directives,
+// and the cache status of the lookup. An entry not accepted is kept in the cache.
+func (u *Cache) Lookup(ctx context.Context, key string, directives Directives) (interface{}, CacheStatus) {
+	ctx, span := tracing.Tracer().Start(ctx, "cache.lookup", trace.WithAttributes(attribute.String("cache.name", u.name)))
+	defer span.End()
+
+	data, status := u.lookup(ctx, key, directives)
+	span.SetAttributes(attribute.Bool("cache.hit", status.Hit), attribute.Bool("cache.grace", status.Grace))
+	if status.Fwd != "" {
+		span.SetAttributes(attribute.String("cache.fwd", status.Fwd))
+	}
+	return data, status
+}
+
+func (u *Cache) lookup(ctx context.Context, key string, directives Directives) (interface{}, CacheStatus) {
+
+	u.mu.Lock()
+	value, ok := u.store.Get(key)
+	if !ok {
+		u.mu.Unlock()
+		cacheMiss.WithLabelValues(u.name).Inc()
+		requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": key}).
+			Info("Cache miss")
+		return nil, CacheStatus{Fwd: FwdMiss}
+	}
+
+	now := time.Now()
+	if !directives.accept(value, now) {
+		u.mu.Unlock()
+		cacheMiss.WithLabelValues(u.name).Inc()
+		requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": key}).
+			Info("Cache entry not accepted by request directives")
+		return nil, CacheStatus{Fwd: FwdRequest}
+	}
+
+	grace := false
+	if value.TTL.Before(now) {
+		// A client max-stale accept the entry also after grace as long as it is kept
+		acceptStale := directives.MaxStale >= 0 && value.StaleTime.After(now)
+		if (value.GraceTime.After(now) && value.UsedCounter > 0) || acceptStale {
+			grace = true
+			url, _ := url.Parse(value.CacheData.RequestURI)
+			header := value.CacheData.RequestHeaders.Clone()
+			if header == nil {
+				header = make(http.Header)
 			}
+			if value.CacheData.Authorization != "" {
+				header.Set("Authorization", value.CacheData.Authorization)
+			}
+
+			r := &http.Request{
+				Method: http.MethodGet,
+				URL:    url,
+				Header: header,
+			}
+			//w := NewCustomResponseWriter()
+			u.refresh(ctx, key, r)
+			requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": key, "used": value.UsedCounter}).
+				Info("TTL expired, grace time")
+		} else if value.StaleTime.After(now) {
+			// Keep the entry so it can be served by GetStale if the upstream fetch fail
+			u.mu.Unlock()
+			cacheMiss.WithLabelValues(u.name).Inc()
+			requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": key}).
+				Info("TTL expired, entry kept for stale-if-error")
+			return nil, CacheStatus{Fwd: FwdStale}
+		} else {
+			u.remove(key)
+			u.mu.Unlock()
+			cacheExpire.WithLabelValues(u.name).Inc()
+			requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": key}).
+				Info("TTL expired, entry removed")
+			return nil, CacheStatus{Fwd: FwdStale}
 		}
-		// re-sort the index
-		u.mu.Lock()
-		u.index.Remove(Element{Value: key})
-		u.index.Add(Element{Value: key, Timestamp: time.Now()})
-		u.mu.Unlock()
-		u.Inc(key)
-		cacheHits.WithLabelValues(u.name).Inc()
-		log.WithFields(log.Fields{"operation": "proxy_cache", "key": key, "used": u.entries[key].usedCounter}).
-			Info("Cache hit")
-		return value.cacheData, true
 	}
-	cacheMiss.WithLabelValues(u.name).Inc()
-	log.WithFields(log.Fields{"operation": "proxy_cache", "key": key}).
-		Info("Cache miss")
-	u.mu.RUnlock()
-	return nil, false
+
+	// update usage, the store will also re-sort its index
+	value.UsedCounter++
+	value.LastUsed = time.Now()
+	u.store.Set(key, value)
+	used := value.UsedCounter
+	data := value.CacheData
+	u.mu.Unlock()
+
+	cacheHits.WithLabelValues(u.name).Inc()
+	requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": key, "used": used}).
+		Info("Cache hit")
+	return data, CacheStatus{Hit: true, Grace: grace}
+}
+
+// GetStale returns the data for the key if the entry exists and is within the stale-if-error time. It
+// should only be used when the upstream fetch of the key failed.
+func (u *Cache) GetStale(ctx context.Context, key string) (interface{}, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	value, ok := u.store.Get(key)
+	if !ok || value.StaleTime.Before(time.Now()) {
+		return nil, false
+	}
+	cacheStale.WithLabelValues(u.name).Inc()
+	requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": key}).
+		Warn("Serve stale entry")
+	return value.CacheData, true
+}
+
+// EntryInfo is the metadata of a cache entry
+type EntryInfo struct {
+	Key         string    `json:"key"`
+	Created     time.Time `json:"created"`
+	TTL         time.Time `json:"ttl"`
+	GraceTime   time.Time `json:"grace_time"`
+	StaleTime   time.Time `json:"stale_time"`
+	UsedCounter int64     `json:"used_counter"`
+	LastUsed    time.Time `json:"last_used"`
+	Size        int64     `json:"size"`
+}
+
+func entryInfo(key string, entry *Entry) EntryInfo {
+	return EntryInfo{
+		Key:         key,
+		Created:     entry.Created,
+		TTL:         entry.TTL,
+		GraceTime:   entry.GraceTime,
+		StaleTime:   entry.StaleTime,
+		UsedCounter: entry.UsedCounter,
+		LastUsed:    entry.LastUsed,
+		Size:        entry.Size,
+	}
+}
+
+// Info returns the metadata of the entry for the key
+func (u *Cache) Info(key string) (EntryInfo, bool) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if entry, exists := u.store.Get(key); exists {
+		return entryInfo(key, entry), true
+	}
+	return EntryInfo{}, false
+}
+
+// Entries returns the metadata of all entries where match return true, least recently used first.
+// A nil match returns all entries.
+func (u *Cache) Entries(match func(key string) bool) []EntryInfo {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	infos := []EntryInfo{}
+	u.store.Iterate(func(key string, entry *Entry) bool {
+		if match == nil || match(key) {
+			infos = append(infos, entryInfo(key, entry))
+		}
+		return true
+	})
+	return infos
+}
+
+// Purge deletes all entries where match return true and return the number of deleted entries.
+// A nil match deletes all entries.
+func (u *Cache) Purge(ctx context.Context, match func(key string) bool) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var keys []string
+	u.store.Iterate(func(key string, entry *Entry) bool {
+		if match == nil || match(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		u.remove(key)
+	}
+	// The cached error responses are purged too, they are not counted as entries
+	var negativeKeys []string
+	u.negative.Iterate(func(key string, entry *Entry) bool {
+		if match == nil || match(key) {
+			negativeKeys = append(negativeKeys, key)
+		}
+		return true
+	})
+	for _, key := range negativeKeys {
+		u.negative.Delete(key)
+	}
+	requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "proxy": u.name, "purged": len(keys)}).
+		Info("proxy_cache entries purged")
+	return len(keys)
+}
+
+// Len returns the number of entries and their estimated size in bytes
+func (u *Cache) Len() (int, int64) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.store.Len(), u.bytes
 }
@@ -0,0 +1,151 @@
+package proxy_cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"web_proxy_cache/config"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func newTestCache(name string, size int) *Cache {
+	return NewCache(config.ConfigProxy{CacheTTL: 600, CacheGrace: 300, CacheSize: size}, name, nil)
+}
+
+func TestSortedSetOrder(t *testing.T) {
+	now := time.Now()
+	set := SortedSet{}
+	set.Add(Element{Value: "b", Timestamp: now.Add(2 * time.Second)})
+	set.Add(Element{Value: "c", Timestamp: now.Add(3 * time.Second)})
+	// Out of order and duplicate elements
+	set.Add(Element{Value: "a", Timestamp: now.Add(time.Second)})
+	set.Add(Element{Value: "b", Timestamp: now.Add(4 * time.Second)})
+
+	var values []string
+	for _, element := range set.Elements() {
+		values = append(values, element.Value)
+	}
+	if fmt.Sprint(values) != "[a b c]" {
+		t.Errorf("Elements() = %v, want [a b c]", values)
+	}
+	if oldest, ok := set.Oldest(); !ok || oldest.Value != "a" {
+		t.Errorf("Oldest() = %v %v, want a", oldest.Value, ok)
+	}
+
+	set.Remove(Element{Value: "a"})
+	if set.Contains(Element{Value: "a"}) || set.Len() != 2 {
+		t.Errorf("after Remove(a) Contains(a) = %v, Len() = %d, want false 2", set.Contains(Element{Value: "a"}), set.Len())
+	}
+	if oldest, ok := set.Oldest(); !ok || oldest.Value != "b" {
+		t.Errorf("Oldest() = %v %v, want b", oldest.Value, ok)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	log.SetOutput(io.Discard)
+	ctx := context.Background()
+	cache := newTestCache("test_evict", 3)
+	for _, key := range []string{"a", "b", "c"} {
+		cache.Set(ctx, key, CacheData{Data: key})
+	}
+	// Setting an existing key makes it the most recently used
+	cache.Set(ctx, "a", CacheData{Data: "a"})
+	cache.Set(ctx, "d", CacheData{Data: "d"})
+
+	if entries, _ := cache.Len(); entries != 3 {
+		t.Errorf("Len() = %d, want 3", entries)
+	}
+	if _, ok := cache.Get(ctx, "b"); ok {
+		t.Error("b is not evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if data, ok := cache.Get(ctx, key); !ok || data.(CacheData).Data != key {
+			t.Errorf("Get(%s) = %v %v, want %s true", key, data, ok, key)
+		}
+	}
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	log.SetOutput(io.Discard)
+	ctx := context.Background()
+	cache := NewCache(config.ConfigProxy{CacheTTL: 600, CacheSize: 10, CacheMaxBytes: 100}, "test_max_bytes", nil)
+	for _, key := range []string{"a", "b", "c"} {
+		if !cache.Set(ctx, key, CacheData{Data: key, Size: 40}) {
+			t.Errorf("Set(%s) = false, want true", key)
+		}
+	}
+	if _, ok := cache.Get(ctx, "a"); ok {
+		t.Error("a is not evicted")
+	}
+
+	// An entry larger than the max bytes is not stored and does not evict the other entries
+	cache.Set(ctx, "big", CacheData{Data: "big", Size: 40})
+	if cache.Set(ctx, "big", CacheData{Data: "big", Size: 101}) {
+		t.Error("Set(big) = true, want false")
+	}
+	if _, ok := cache.Get(ctx, "big"); ok {
+		t.Error("the previous entry of big is kept")
+	}
+	if _, ok := cache.Get(ctx, "c"); !ok {
+		t.Error("c is evicted")
+	}
+	if _, bytes := cache.Len(); bytes != 40 {
+		t.Errorf("Len() bytes = %d, want 40", bytes)
+	}
+}
+
+func TestCachePurgeNegative(t *testing.T) {
+	log.SetOutput(io.Discard)
+	ctx := context.Background()
+	cache := NewCache(config.ConfigProxy{CacheSize: 10, CacheNegativeTTL: 60}, "test_purge_negative", nil)
+	for _, key := range []string{"a/1", "a/2", "b/1"} {
+		cache.SetError(ctx, key, NewErrorResponse("Not found", 404))
+	}
+
+	if !cache.Delete(ctx, "a/1") {
+		t.Error("Delete(a/1) = false, want true")
+	}
+	if _, ok := cache.GetError(ctx, "a/1"); ok {
+		t.Error("Delete(a/1) kept the error response")
+	}
+	if cache.Delete(ctx, "a/1") {
+		t.Error("Delete(a/1) of a removed key = true, want false")
+	}
+	cache.Purge(ctx, func(key string) bool { return strings.HasPrefix(key, "b/") })
+	if _, ok := cache.GetError(ctx, "b/1"); ok {
+		t.Error("Purge(b/) kept the error response of b/1")
+	}
+	if _, ok := cache.GetError(ctx, "a/2"); !ok {
+		t.Error("Purge(b/) removed the error response of a/2")
+	}
+	cache.Purge(ctx, nil)
+	if _, ok := cache.GetError(ctx, "a/2"); ok {
+		t.Error("Purge(nil) kept the error response of a/2")
+	}
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	log.SetOutput(io.Discard)
+	ctx := context.Background()
+	for _, size := range []int{100, 10_000, 100_000} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			cache := newTestCache(fmt.Sprintf("bench_get_%d", size), size)
+			keys := make([]string, size)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("https://netbox.example/api/dcim/devices/?offset=%d", i)
+				cache.Set(ctx, keys[i], CacheData{Data: i, Size: 1})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok := cache.Get(ctx, keys[i%size]); !ok {
+					b.Fatalf("miss on %s", keys[i%size])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package proxy_cache
+
+import (
+	"crypto/subtle"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheTokenHeader is the request header a client use to authorize directives that force a refetch
+const CacheTokenHeader = "X-Proxy-Cache-Token"
+
+// Directives are the client Cache-Control request directives that constrain the cache lookup
+type Directives struct {
+	// NoCache forces a refetch from the upstream
+	NoCache bool
+	// MaxAge is the max age in seconds of an accepted entry, -1 if not set
+	MaxAge int64
+	// MaxStale is the max time in seconds after TTL an entry is accepted, -1 if not set
+	MaxStale int64
+	// OnlyIfCached never calls the upstream
+	OnlyIfCached bool
+}
+
+// maxSeconds is the largest number of seconds that fits in a time.Duration, larger values are capped
+const maxSeconds = math.MaxInt64 / int64(time.Second)
+
+// NoDirectives is the default cache lookup
+var NoDirectives = Directives{MaxAge: -1, MaxStale: -1}
+
+// ParseDirectives parses the Cache-Control header of the request. If token is set the directives that
+// force a refetch, no-cache and max-age, are only honored if the request header X-Proxy-Cache-Token
+// match the token.
+func ParseDirectives(r *http.Request, token string) Directives {
+	directives := NoDirectives
+	for _, value := range r.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			arg = strings.Trim(arg, `"`)
+			switch strings.ToLower(name) {
+			case "no-cache":
+				directives.NoCache = true
+			case "max-age":
+				if seconds, ok := parseSeconds(arg); ok {
+					directives.MaxAge = seconds
+				}
+			case "max-stale":
+				if arg == "" {
+					// max-stale without a value accept any stale entry
+					directives.MaxStale = maxSeconds
+				} else if seconds, ok := parseSeconds(arg); ok {
+					directives.MaxStale = seconds
+				}
+			case "only-if-cached":
+				directives.OnlyIfCached = true
+			}
+		}
+	}
+
+	if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(CacheTokenHeader)), []byte(token)) != 1 {
+		directives.NoCache = false
+		directives.MaxAge = -1
+	}
+	return directives
+}
+
+// parseSeconds parses a non-negative delta-seconds value, capped at maxSeconds
+func parseSeconds(arg string) (int64, bool) {
+	seconds, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		// A value too large for int64 is a valid delta-seconds
+		if errors.Is(err, strconv.ErrRange) && !strings.HasPrefix(arg, "-") {
+			return maxSeconds, true
+		}
+		return 0, false
+	}
+	if seconds < 0 {
+		return 0, false
+	}
+	return min(seconds, maxSeconds), true
+}
+
+// accept returns true if the entry can be served to a request with the directives. The entry is past
+// its TTL if stale is greater than zero.
+func (d Directives) accept(entry *Entry, now time.Time) bool {
+	if d.NoCache {
+		return false
+	}
+	if d.MaxAge >= 0 && now.Sub(entry.Created) > time.Duration(d.MaxAge)*time.Second {
+		return false
+	}
+	stale := now.Sub(entry.TTL)
+	if d.MaxStale >= 0 && stale > time.Duration(d.MaxStale)*time.Second {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,84 @@
+package proxy_cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseDirectives(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		token        string
+		tokenHeader  string
+		want         Directives
+	}{
+		{name: "none", want: NoDirectives},
+		{name: "no-cache", cacheControl: "no-cache", want: Directives{NoCache: true, MaxAge: -1, MaxStale: -1}},
+		{name: "max-age", cacheControl: "max-age=60", want: Directives{MaxAge: 60, MaxStale: -1}},
+		{name: "quoted max-age", cacheControl: `max-age="60"`, want: Directives{MaxAge: 60, MaxStale: -1}},
+		{name: "negative max-age", cacheControl: "max-age=-1", want: NoDirectives},
+		{name: "huge max-age", cacheControl: "max-age=99999999999999999999", want: Directives{MaxAge: maxSeconds, MaxStale: -1}},
+		{name: "max-stale", cacheControl: "max-stale=30", want: Directives{MaxAge: -1, MaxStale: 30}},
+		{name: "bare max-stale", cacheControl: "max-stale", want: Directives{MaxAge: -1, MaxStale: maxSeconds}},
+		{name: "huge max-stale", cacheControl: "max-stale=9223372036854775807", want: Directives{MaxAge: -1, MaxStale: maxSeconds}},
+		{name: "only-if-cached", cacheControl: "only-if-cached", want: Directives{MaxAge: -1, MaxStale: -1, OnlyIfCached: true}},
+		{name: "several", cacheControl: "No-Cache, max-stale=5", want: Directives{NoCache: true, MaxAge: -1, MaxStale: 5}},
+		{name: "without token", cacheControl: "no-cache, max-age=0, max-stale", token: "secret",
+			want: Directives{MaxAge: -1, MaxStale: maxSeconds}},
+		{name: "wrong token", cacheControl: "no-cache", token: "secret", tokenHeader: "wrong", want: NoDirectives},
+		{name: "token", cacheControl: "no-cache, max-age=0", token: "secret", tokenHeader: "secret",
+			want: Directives{NoCache: true, MaxAge: 0, MaxStale: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/", nil)
+			if tt.cacheControl != "" {
+				r.Header.Set("Cache-Control", tt.cacheControl)
+			}
+			if tt.tokenHeader != "" {
+				r.Header.Set(CacheTokenHeader, tt.tokenHeader)
+			}
+			if got := ParseDirectives(r, tt.token); got != tt.want {
+				t.Errorf("ParseDirectives(%q) = %+v, want %+v", tt.cacheControl, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirectivesAccept(t *testing.T) {
+	now := time.Now()
+	fresh := &Entry{Created: now.Add(-10 * time.Second), TTL: now.Add(time.Minute)}
+	expired := &Entry{Created: now.Add(-2 * time.Hour), TTL: now.Add(-time.Hour)}
+
+	tests := []struct {
+		name         string
+		cacheControl string
+		entry        *Entry
+		want         bool
+	}{
+		{name: "fresh", entry: fresh, want: true},
+		{name: "expired", entry: expired, want: true},
+		{name: "no-cache", cacheControl: "no-cache", entry: fresh, want: false},
+		{name: "max-age older", cacheControl: "max-age=5", entry: fresh, want: false},
+		{name: "max-age younger", cacheControl: "max-age=60", entry: fresh, want: true},
+		{name: "max-stale fresh", cacheControl: "max-stale=0", entry: fresh, want: true},
+		{name: "max-stale too stale", cacheControl: "max-stale=60", entry: expired, want: false},
+		{name: "max-stale stale enough", cacheControl: "max-stale=7200", entry: expired, want: true},
+		{name: "bare max-stale", cacheControl: "max-stale", entry: expired, want: true},
+		{name: "huge max-stale", cacheControl: "max-stale=9223372036854775807", entry: expired, want: true},
+		{name: "huge max-age", cacheControl: "max-age=9223372036854775807", entry: expired, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/", nil)
+			if tt.cacheControl != "" {
+				r.Header.Set("Cache-Control", tt.cacheControl)
+			}
+			if got := ParseDirectives(r, "").accept(tt.entry, now); got != tt.want {
+				t.Errorf("accept with %q = %v, want %v", tt.cacheControl, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package proxy_cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"web_proxy_cache/config"
+	"web_proxy_cache/requestid"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var cacheNegativeHits = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: config.MetricsPrefix + "cache_negative_hits_total",
+		Help: "Cache hits on cached upstream error responses",
+	},
+	[]string{"proxy"},
+)
+
+// ErrorResponse is an upstream error response kept in the negative cache. It is also used as the
+// error returned by a provider fetch when the upstream respond with an error status.
+type ErrorResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+func (e ErrorResponse) Error() string {
+	return fmt.Sprintf("upstream responded with status %d", e.Status)
+}
+
+// NewErrorResponse creates a plain text error response like http.Error
+func NewErrorResponse(text string, status int) ErrorResponse {
+	return ErrorResponse{
+		Status: status,
+		Header: http.Header{
+			"Content-Type":           {"text/plain; charset=utf-8"},
+			"X-Content-Type-Options": {"nosniff"},
+		},
+		Body: []byte(text + "\n"),
+	}
+}
+
+// Write writes the error response with the original status code and body to w
+func (e ErrorResponse) Write(w http.ResponseWriter) {
+	for name, values := range e.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(e.Status)
+	_, _ = w.Write(e.Body)
+}
+
+// SetError keeps the upstream error response for the key for the negative TTL. The entry is kept
+// separate from the data entries so a cached error never replace good data.
+func (u *Cache) SetError(ctx context.Context, key string, response ErrorResponse) {
+	if u.negativeTTL <= 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, exists := u.negative.Get(key); !exists && u.negative.Len() >= u.maxSize {
+		u.negative.Evict()
+	}
+	u.negative.Set(key, &Entry{
+		TTL:       time.Now().Add(time.Duration(u.negativeTTL) * time.Second),
+		CacheData: CacheData{Data: response},
+	})
+	requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": key, "status": response.Status}).
+		Info("Cache upstream error")
+}
+
+// GetError returns the cached upstream error response for the key if not expired
+func (u *Cache) GetError(ctx context.Context, key string) (ErrorResponse, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	value, ok := u.negative.Get(key)
+	if !ok {
+		return ErrorResponse{}, false
+	}
+	if value.TTL.Before(time.Now()) {
+		u.negative.Delete(key)
+		return ErrorResponse{}, false
+	}
+	cacheNegativeHits.WithLabelValues(u.name).Inc()
+	requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": key}).
+		Info("Cache negative hit")
+	return value.CacheData.Data.(ErrorResponse), true
+}
@@ -0,0 +1,108 @@
+package proxy_cache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"web_proxy_cache/config"
+	"web_proxy_cache/requestid"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var cacheBytes = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: config.MetricsPrefix + "cache_bytes",
+		Help: "Estimated size in bytes of all cache entries",
+	},
+	[]string{"proxy"},
+)
+var cacheEntries = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: config.MetricsPrefix + "cache_entries",
+		Help: "Number of cache entries",
+	},
+	[]string{"proxy"},
+)
+var cacheSkipped = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: config.MetricsPrefix + "cache_skipped_total",
+		Help: "Upstream responses not stored since they are larger than the max bytes of the cache",
+	},
+	[]string{"proxy"},
+)
+
+// estimateSize returns the size in bytes of the cache data. If the provider did not set the Size of
+// the data the size of the JSON encoding of the data is used.
+func estimateSize(data CacheData) int64 {
+	size := headerSize(data.RequestHeaders) + headerSize(data.ResponseHeaders)
+	if data.Size > 0 {
+		return size + data.Size
+	}
+	encoded, err := json.Marshal(data.Data)
+	if err != nil {
+		return size
+	}
+	return size + int64(len(encoded))
+}
+
+func headerSize(header http.Header) int64 {
+	var size int64
+	for name, values := range header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+// add stores the entry and evict the least recently used entries until both the entry count and the
+// byte limit is met. An entry larger than the byte limit is not stored, it would evict all other entries.
+// Returns true if the entry was stored. Must be called with the cache lock held.
+func (u *Cache) add(ctx context.Context, key string, entry *Entry) bool {
+	// The previous entry is removed either way, it is older than the entry
+	u.remove(key)
+	if u.maxBytes > 0 && entry.Size > u.maxBytes {
+		cacheSkipped.WithLabelValues(u.name).Inc()
+		requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": key, "size": entry.Size, "max_bytes": u.maxBytes}).
+			Warn("proxy_cache entry larger than max bytes, not stored")
+		return false
+	}
+
+	for u.store.Len() > 0 &&
+		(u.store.Len() >= u.maxSize || (u.maxBytes > 0 && u.bytes+entry.Size > u.maxBytes)) {
+		oldest, evicted, ok := u.store.Evict()
+		if !ok {
+			break
+		}
+		u.bytes -= evicted.Size
+		requestid.Log(ctx).WithFields(log.Fields{"operation": "proxy_cache", "key": oldest, "size": evicted.Size}).
+			Info("proxy_cache size limit reached")
+	}
+
+	u.store.Set(key, entry)
+	u.bytes += entry.Size
+	u.updateGauges()
+	return true
+}
+
+// remove deletes the entry for the key and return true if it existed. Must be called with the cache
+// lock held.
+func (u *Cache) remove(key string) bool {
+	entry, exists := u.store.Get(key)
+	if !exists {
+		return false
+	}
+	u.store.Delete(key)
+	u.bytes -= entry.Size
+	u.updateGauges()
+	return true
+}
+
+func (u *Cache) updateGauges() {
+	cacheBytes.WithLabelValues(u.name).Set(float64(u.bytes))
+	cacheEntries.WithLabelValues(u.name).Set(float64(u.store.Len()))
+}
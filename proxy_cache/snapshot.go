@@ -0,0 +1,242 @@
+package proxy_cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DataDecoder decodes the Data part of a CacheData, read from a snapshot, into the type the provider
+// stored in the cache
+type DataDecoder func(raw json.RawMessage) (interface{}, error)
+
+type snapshot struct {
+	Name    string          `json:"name"`
+	Created time.Time       `json:"created"`
+	Entries []snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Key             string          `json:"key"`
+	Created         time.Time       `json:"created"`
+	LastUsed        time.Time       `json:"last_used"`
+	TTL             time.Time       `json:"ttl"`
+	UsedCounter     int64           `json:"used_counter"`
+	GraceTime       time.Time       `json:"grace_time"`
+	StaleTime       time.Time       `json:"stale_time"`
+	Size            int64           `json:"size"`
+	RequestURI      string          `json:"request_uri"`
+	RequestHeaders  http.Header     `json:"request_headers"`
+	ResponseHeaders http.Header     `json:"response_headers"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// SetDataDecoder sets the decoder used to restore the Data of the entries from a snapshot. A cache
+// without a decoder is not included in snapshots.
+func (u *Cache) SetDataDecoder(decoder DataDecoder) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.decoder = decoder
+}
+
+// Snapshot writes all entries of the cache to w
+func (u *Cache) Snapshot(w io.Writer) error {
+	u.mu.RLock()
+	var entries []Entry
+	var keys []string
+	u.store.Iterate(func(key string, entry *Entry) bool {
+		keys = append(keys, key)
+		entries = append(entries, *entry)
+		return true
+	})
+	u.mu.RUnlock()
+
+	snap := snapshot{Name: u.name, Created: time.Now()}
+	for i, entry := range entries {
+		data, err := json.Marshal(entry.CacheData.Data)
+		if err != nil {
+			return fmt.Errorf("encode data for key %s: %w", keys[i], err)
+		}
+		snap.Entries = append(snap.Entries, snapshotEntry{
+			Key:             keys[i],
+			Created:         entry.Created,
+			LastUsed:        entry.LastUsed,
+			TTL:             entry.TTL,
+			UsedCounter:     entry.UsedCounter,
+			GraceTime:       entry.GraceTime,
+			StaleTime:       entry.StaleTime,
+			Size:            entry.Size,
+			RequestURI:      entry.CacheData.RequestURI,
+			RequestHeaders:  entry.CacheData.RequestHeaders,
+			ResponseHeaders: entry.CacheData.ResponseHeaders,
+			Data:            data,
+		})
+	}
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// Restore reads a snapshot from r and adds all entries that are still valid or in grace to the cache.
+// It returns the number of entries restored.
+func (u *Cache) Restore(r io.Reader) (int, error) {
+	u.mu.RLock()
+	decoder := u.decoder
+	u.mu.RUnlock()
+	if decoder == nil {
+		return 0, fmt.Errorf("no data decoder for cache %s", u.name)
+	}
+
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return 0, err
+	}
+	if snap.Name != u.name {
+		return 0, fmt.Errorf("snapshot is for cache %s, not %s", snap.Name, u.name)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	restored := 0
+	now := time.Now()
+	for _, e := range snap.Entries {
+		if e.StaleTime.Before(e.GraceTime) {
+			e.StaleTime = e.GraceTime
+		}
+		if e.StaleTime.Before(now) {
+			continue
+		}
+		data, err := decoder(e.Data)
+		if err != nil {
+			log.WithFields(log.Fields{"operation": "proxy_cache", "key": e.Key, "error": err}).
+				Warn("Skip snapshot entry")
+			continue
+		}
+		// Snapshots of older versions include the Authorization header
+		e.RequestHeaders.Del("Authorization")
+		cacheData := CacheData{
+			RequestURI:      e.RequestURI,
+			RequestHeaders:  e.RequestHeaders,
+			ResponseHeaders: e.ResponseHeaders,
+			Data:            data,
+		}
+		size := e.Size
+		if size == 0 {
+			size = estimateSize(cacheData)
+		}
+		stored := u.add(context.Background(), e.Key, &Entry{
+			Created:     e.Created,
+			LastUsed:    e.LastUsed,
+			TTL:         e.TTL,
+			UsedCounter: e.UsedCounter,
+			GraceTime:   e.GraceTime,
+			StaleTime:   e.StaleTime,
+			Size:        size,
+			CacheData:   cacheData,
+		})
+		if stored {
+			restored++
+		}
+	}
+	return restored, nil
+}
+
+// SaveSnapshot writes the snapshot of the cache to the file path. The file is written to a temporary
+// file first and then renamed so a crash never leave a partial snapshot.
+func (u *Cache) SaveSnapshot(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// The snapshot include the request headers, e.g. Authorization, so keep it private
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := u.Snapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot restores the cache from the snapshot file path
+func (u *Cache) LoadSnapshot(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return u.Restore(f)
+}
+
+func snapshotPath(dir string, name string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.json", name))
+}
+
+// SaveSnapshots writes a snapshot file for each cache that has a data decoder to dir
+func SaveSnapshots(dir string) {
+	for name, cache := range Caches() {
+		if !cache.hasDecoder() {
+			continue
+		}
+		start := time.Now()
+		if err := cache.SaveSnapshot(snapshotPath(dir, name)); err != nil {
+			log.WithFields(log.Fields{"operation": "snapshot", "proxy": name, "error": err}).
+				Error("Save snapshot")
+			continue
+		}
+		log.WithFields(log.Fields{"operation": "snapshot", "proxy": name, "exectime": time.Since(start).Milliseconds()}).
+			Info("Save snapshot")
+	}
+}
+
+// LoadSnapshots restores each cache that has a data decoder from its snapshot file in dir
+func LoadSnapshots(dir string) {
+	for name, cache := range Caches() {
+		if !cache.hasDecoder() {
+			continue
+		}
+		restored, err := cache.LoadSnapshot(snapshotPath(dir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			log.WithFields(log.Fields{"operation": "snapshot", "proxy": name, "error": err}).
+				Error("Load snapshot")
+			continue
+		}
+		log.WithFields(log.Fields{"operation": "snapshot", "proxy": name, "entries": restored}).
+			Info("Load snapshot")
+	}
+}
+
+// RunSnapshots saves the snapshots of all caches to dir every interval until ctx is done
+func RunSnapshots(ctx context.Context, dir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			SaveSnapshots(dir)
+		}
+	}
+}
+
+func (u *Cache) hasDecoder() bool {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.decoder != nil
+}
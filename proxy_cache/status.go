@@ -0,0 +1,108 @@
+package proxy_cache
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// CacheStatusName is the cache identifier used in the Cache-Status header
+	CacheStatusName = "web_proxy_cache"
+	// FetchedAtHeader is the response header with the time the data was fetched from the upstream
+	FetchedAtHeader = "X-Proxy-Fetched-At"
+)
+
+// Forward reasons for the Cache-Status fwd parameter, RFC 9211
+const (
+	FwdMiss    = "miss"
+	FwdRequest = "request"
+	FwdStale   = "stale"
+)
+
+// CacheStatus describe how a request was handled by the cache
+type CacheStatus struct {
+	// Hit is true if the request was answered from the cache without calling the upstream
+	Hit bool
+	// Fwd is the reason the request was forwarded to the upstream
+	Fwd string
+	// FwdStatus is the status code of the upstream response, if forwarded
+	FwdStatus int
+	// Stored is true if the upstream response was stored in the cache
+	Stored bool
+	// Grace is true if an expired entry was served while it is refreshed in the background
+	Grace bool
+	// Stale is true if an expired entry was served since the upstream failed
+	Stale bool
+	// Negative is true if the response is a cached upstream error
+	Negative bool
+}
+
+// SetHeaders sets the RFC 9211 Cache-Status header on the response. If the response is built from the
+// cache entry for the key, the Age and X-Proxy-Fetched-At headers are set as well.
+func (u *Cache) SetHeaders(header http.Header, key string, status CacheStatus) {
+	params := []string{CacheStatusName}
+	if status.Hit {
+		params = append(params, "hit")
+	}
+	if status.Fwd != "" {
+		params = append(params, "fwd="+status.Fwd)
+	}
+	if status.FwdStatus != 0 {
+		params = append(params, fmt.Sprintf("fwd-status=%d", status.FwdStatus))
+	}
+	if status.Stored {
+		params = append(params, "stored")
+	}
+
+	info, exists := u.Info(key)
+	if exists && !status.Negative && (status.Hit || status.Stored || status.Stale) {
+		now := time.Now()
+		params = append(params, fmt.Sprintf("ttl=%d", int64(math.Round(info.TTL.Sub(now).Seconds()))))
+		header.Set("Age", strconv.FormatInt(int64(math.Max(0, now.Sub(info.Created).Seconds())), 10))
+		header.Set(FetchedAtHeader, info.Created.Format(time.RFC3339))
+	}
+
+	if status.Negative {
+		params = append(params, `detail="negative"`)
+	} else if status.Stale {
+		params = append(params, `detail="stale-if-error"`)
+	} else if status.Grace {
+		params = append(params, `detail="grace"`)
+	}
+	header.Set("Cache-Status", strings.Join(params, "; "))
+}
+
+// Cache results of a response, used as the cache label of the request metrics
+const (
+	ResultHit   = "hit"
+	ResultMiss  = "miss"
+	ResultStale = "stale"
+	// ResultNone is a response not handled by the cache, e.g. a rejected request
+	ResultNone = "none"
+)
+
+// CacheResult returns the cache result from the Cache-Status header of the response. A grace hit and a
+// stale-if-error response are both stale, a refetch of an expired entry is a miss.
+func CacheResult(header http.Header) string {
+	value := header.Get("Cache-Status")
+	if !strings.HasPrefix(value, CacheStatusName) {
+		return ResultNone
+	}
+	hit := false
+	for _, param := range strings.Split(value, ";") {
+		switch strings.TrimSpace(param) {
+		case "hit":
+			hit = true
+		case `detail="grace"`, `detail="stale-if-error"`:
+			return ResultStale
+		}
+	}
+	if hit {
+		return ResultHit
+	}
+	return ResultMiss
+}
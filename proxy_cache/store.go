@@ -0,0 +1,95 @@
+package proxy_cache
+
+import (
+	"time"
+)
+
+// Entry is a single cached object together with the metadata the Cache use for TTL, grace and
+// usage tracking.
+type Entry struct {
+	// Created is the time the data was fetched from the upstream
+	Created     time.Time
+	LastUsed    time.Time
+	TTL         time.Time
+	UsedCounter int64
+	GraceTime   time.Time
+	// StaleTime is the time until the entry can be served if the upstream fetch fail
+	StaleTime time.Time
+	// Size is the estimated size in bytes of the entry
+	Size      int64
+	CacheData CacheData
+}
+
+// Store is the storage backend of a Cache. The Cache serialize all calls to the Store so an
+// implementation do not need to be safe for concurrent use.
+type Store interface {
+	// Get returns the entry for the key without changing its position in the eviction order
+	Get(key string) (*Entry, bool)
+	// Set stores the entry for the key and mark it as the most recently used
+	Set(key string, entry *Entry)
+	// Delete removes the entry for the key and return true if it existed
+	Delete(key string) bool
+	// Iterate calls fn for each entry, from the least to the most recently used, until fn return false
+	Iterate(fn func(key string, entry *Entry) bool)
+	// Evict removes the least recently used entry and return its key and entry
+	Evict() (string, *Entry, bool)
+	// Len returns the number of entries in the store
+	Len() int
+}
+
+// memoryStore is the default Store that keep all entries in a map with a SortedSet as the LRU index
+type memoryStore struct {
+	entries map[string]*Entry
+	index   SortedSet
+}
+
+// NewMemoryStore creates an in-memory Store
+func NewMemoryStore() Store {
+	return &memoryStore{
+		entries: make(map[string]*Entry),
+		index:   SortedSet{},
+	}
+}
+
+func (m *memoryStore) Get(key string) (*Entry, bool) {
+	entry, ok := m.entries[key]
+	return entry, ok
+}
+
+func (m *memoryStore) Set(key string, entry *Entry) {
+	m.entries[key] = entry
+	m.index.Remove(Element{Value: key})
+	m.index.Add(Element{Value: key, Timestamp: time.Now()})
+}
+
+func (m *memoryStore) Delete(key string) bool {
+	if _, exists := m.entries[key]; !exists {
+		return false
+	}
+	delete(m.entries, key)
+	m.index.Remove(Element{Value: key})
+	return true
+}
+
+func (m *memoryStore) Iterate(fn func(key string, entry *Entry) bool) {
+	for _, element := range m.index.Elements() {
+		if !fn(element.Value, m.entries[element.Value]) {
+			return
+		}
+	}
+}
+
+func (m *memoryStore) Evict() (string, *Entry, bool) {
+	oldest, ok := m.index.Oldest()
+	if !ok {
+		return "", nil, false
+	}
+	entry := m.entries[oldest.Value]
+	delete(m.entries, oldest.Value)
+	m.index.Remove(oldest)
+	return oldest.Value, entry, true
+}
+
+func (m *memoryStore) Len() int {
+	return len(m.entries)
+}
@@ -0,0 +1,59 @@
+package requestid
+
+import (
+	"context"
+
+	"github.com/segmentio/ksuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Header is the request and response header with the request id, it is also sent to the upstream
+	Header = "X-Request-Id"
+	// LogField is the log field with the request id
+	LogField = "requestid"
+	// maxLength is the max length of an incoming request id, a longer id is replaced
+	maxLength = 128
+)
+
+type contextKey struct{}
+
+// New returns a new request id
+func New() string {
+	return ksuid.New().String()
+}
+
+// Valid returns true if the incoming id is not empty, not too long and only has letters, digits and
+// the characters - _ . : so it is safe to log and to send to the upstream
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NewContext returns ctx with the request id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request id of ctx, or an empty string if ctx has none
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Log returns a log entry with the request id of ctx, if any
+func Log(ctx context.Context) *logrus.Entry {
+	if id := FromContext(ctx); id != "" {
+		return logrus.WithField(LogField, id)
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
@@ -0,0 +1,187 @@
+package tlsserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Client certificate verification
+const (
+	ClientAuthRequire  = "require"
+	ClientAuthOptional = "optional"
+)
+
+// Config is the TLS configuration of the server
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the PEM bundle of CAs used to verify client certificates, if empty no mTLS
+	ClientCAFile string
+	// ClientAuth is require or optional, default require
+	ClientAuth string
+	// MinVersion is 1.2 or 1.3, default 1.2
+	MinVersion string
+}
+
+// Reloader serves the certificate and client CAs from the files and reloads them when the files change
+type Reloader struct {
+	cfg        Config
+	minVersion uint16
+	clientAuth tls.ClientAuthType
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// New validates the configuration and loads the certificate and client CAs
+func New(cfg Config) (*Reloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("both cert file and key file must be set")
+	}
+	r := &Reloader{cfg: cfg}
+
+	switch cfg.MinVersion {
+	case "", "1.2":
+		r.minVersion = tls.VersionTLS12
+	case "1.3":
+		r.minVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported min version %q, must be 1.2 or 1.3", cfg.MinVersion)
+	}
+
+	switch cfg.ClientAuth {
+	case "", ClientAuthRequire:
+		r.clientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthOptional:
+		r.clientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unsupported client auth %q, must be %s or %s", cfg.ClientAuth, ClientAuthRequire, ClientAuthOptional)
+	}
+
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns the server TLS configuration that always use the last loaded files. It offers h2
+// and http/1.1 with ALPN, also to clients verified with the client CAs.
+func (r *Reloader) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: r.minVersion,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+	}
+	// The client CAs can only be changed with a configuration per connection
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		if r.clientCA == nil {
+			return nil, nil
+		}
+		clientConfig := config.Clone()
+		clientConfig.GetConfigForClient = nil
+		clientConfig.ClientCAs = r.clientCA
+		clientConfig.ClientAuth = r.clientAuth
+		return clientConfig, nil
+	}
+	return config
+}
+
+// Run checks the files every interval and reloads them if changed, until ctx is done. A failed reload
+// keeps the previous certificate.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.reload()
+			if err != nil {
+				log.WithFields(log.Fields{"operation": "tls", "error": err}).Error("Reload certificate")
+				continue
+			}
+			if reloaded {
+				log.WithFields(log.Fields{"operation": "tls", "cert": r.cfg.CertFile, "expire": r.notAfter()}).
+					Info("Reload certificate")
+			}
+		}
+	}
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+// reload loads the files if any of them changed since the last load
+func (r *Reloader) reload() (bool, error) {
+	modTimes := make(map[string]time.Time)
+	changed := false
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTimes[file] = info.ModTime()
+		r.mu.RLock()
+		previous, ok := r.modTimes[file]
+		r.mu.RUnlock()
+		if !ok || !previous.Equal(info.ModTime()) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("load certificate: %w", err)
+	}
+	var clientCA *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return false, fmt.Errorf("read client ca file: %w", err)
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("no certificates in client ca file %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCA = clientCA
+	r.modTimes = modTimes
+	return true, nil
+}
+
+func (r *Reloader) notAfter() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert.Leaf == nil {
+		return time.Time{}
+	}
+	return r.cert.Leaf.NotAfter
+}